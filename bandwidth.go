@@ -0,0 +1,128 @@
+package p2p
+
+import (
+	"github.com/xfs-network/xlibp2p/discover"
+	"github.com/xfs-network/xlibp2p/netutil"
+	"time"
+)
+
+// Bandwidth is the traffic of a scope in bytes. Rates are measured over
+// the last seconds, limits of zero mean unlimited.
+type Bandwidth struct {
+	IngressRate  float64
+	EgressRate   float64
+	IngressTotal uint64
+	EgressTotal  uint64
+	IngressLimit int
+	EgressLimit  int
+}
+
+// BandwidthStats is the traffic of the server. Total is the TCP traffic
+// of all peers, Protocols the traffic of each protocol across all peers.
+type BandwidthStats struct {
+	Total     Bandwidth
+	Discovery Bandwidth
+	Peers     map[discover.NodeId]Bandwidth
+	Protocols map[string]Bandwidth
+}
+
+// bandwidth limits and measures the traffic of a scope in both directions.
+type bandwidth struct {
+	ingress *netutil.Limiter
+	egress  *netutil.Limiter
+}
+
+func newBandwidth(limit netutil.RateLimit) *bandwidth {
+	return &bandwidth{
+		ingress: netutil.NewLimiter(limit.Ingress),
+		egress:  netutil.NewLimiter(limit.Egress),
+	}
+}
+
+func (b *bandwidth) usage() Bandwidth {
+	return Bandwidth{
+		IngressRate:  b.ingress.Rate(),
+		EgressRate:   b.egress.Rate(),
+		IngressTotal: b.ingress.Total(),
+		EgressTotal:  b.egress.Total(),
+		IngressLimit: b.ingress.Limit(),
+		EgressLimit:  b.egress.Limit(),
+	}
+}
+
+// throttle charges n bytes to the limiters and waits until all of them
+// have recovered, it returns false if cancel was closed meanwhile.
+func throttle(n int, cancel chan struct{}, limiters ...*netutil.Limiter) bool {
+	var wait time.Duration
+	for _, l := range limiters {
+		if d := l.Reserve(n); d > wait {
+			wait = d
+		}
+	}
+	if wait <= 0 {
+		return true
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+// limiters returns the limiters of a message in one direction.
+func (p *peer) limiters(mType uint8, egress bool) []*netutil.Limiter {
+	scopes := []*bandwidth{p.traffic}
+	if p.conn.server != nil {
+		scopes = append(scopes, p.conn.server.traffic)
+	}
+	if rw := p.protoRW(mType); rw != nil && rw.traffic != nil {
+		scopes = append(scopes, rw.traffic)
+	}
+	limiters := make([]*netutil.Limiter, len(scopes))
+	for i, b := range scopes {
+		limiters[i] = b.ingress
+		if egress {
+			limiters[i] = b.egress
+		}
+	}
+	return limiters
+}
+
+// Bandwidth returns the traffic of the server, its peers and protocols.
+func (srv *server) Bandwidth() BandwidthStats {
+	stats := BandwidthStats{
+		Total:     srv.traffic.usage(),
+		Discovery: srv.udpTraffic.usage(),
+		Peers:     make(map[discover.NodeId]Bandwidth),
+		Protocols: make(map[string]Bandwidth),
+	}
+	srv.peersMu.RLock()
+	for id, p := range srv.peers {
+		if p, ok := p.(*peer); ok {
+			stats.Peers[id] = p.traffic.usage()
+		}
+	}
+	srv.peersMu.RUnlock()
+	srv.trafficMu.Lock()
+	for name, b := range srv.protoTraffic {
+		stats.Protocols[name] = b.usage()
+	}
+	srv.trafficMu.Unlock()
+	return stats
+}
+
+// protocolTraffic returns the shared scope of a protocol, it is created
+// on first use.
+func (srv *server) protocolTraffic(name string) *bandwidth {
+	srv.trafficMu.Lock()
+	defer srv.trafficMu.Unlock()
+	b := srv.protoTraffic[name]
+	if b == nil {
+		b = newBandwidth(srv.config.ProtocolRateLimits[name])
+		srv.protoTraffic[name] = b
+	}
+	return b
+}
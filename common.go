@@ -2,6 +2,9 @@ package p2p
 
 const (
 	version1 uint8 = 1
+	// version2 replaced the plaintext hello exchange with the
+	// authenticated handshake and encrypted channel.
+	version2 uint8 = 2
 )
 
 const (
@@ -9,6 +12,8 @@ const (
 	typeReHelloRequest uint8 = 1
 	typePingMsg uint8 = 2
 	typePongMsg uint8 = 3
+	typeProtoHandshake uint8 = 4
+	typeDiscMsg uint8 = 5
 )
 
 func SendMsgData(p Peer, mType uint8, obj interface{}) error {
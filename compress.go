@@ -0,0 +1,94 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"github.com/golang/snappy"
+	"sync"
+)
+
+// flagCompressed is set in the version byte of messages whose data
+// is compressed with the codec negotiated in the protocol handshake.
+const flagCompressed uint8 = 0x80
+
+// defaultCompressThreshold is the default size from which the data of
+// protocol messages is compressed.
+const defaultCompressThreshold = 512
+
+var errBadCompression = errors.New("invalid compressed message")
+
+// Codec compresses the data of protocol messages. Codecs are announced
+// by name in the protocol handshake, so both sides must register a codec
+// under the same name for it to be used.
+type Codec interface {
+	Name() string
+	Compress(data []byte) []byte
+	// Decompress must fail without allocating the result if the data
+	// would decompress to more than max bytes.
+	Decompress(data []byte, max uint32) ([]byte, error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{"snappy": snappyCodec{}}
+)
+
+// RegisterCodec makes a codec available to the protocol handshake,
+// it replaces a codec registered under the same name.
+func RegisterCodec(c Codec) error {
+	name := c.Name()
+	if name == "" || len(name) > maxCodecNameLen {
+		return fmt.Errorf("invalid codec name: %q", name)
+	}
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[name] = c
+	return nil
+}
+
+func lookupCodec(name string) Codec {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	return codecs[name]
+}
+
+// negotiateCodec returns the first codec offered by the dialing side
+// which the listening side offered too, or nil. Both sides pass the
+// lists in the same order and so choose the same codec.
+func negotiateCodec(dialer, listener []string) Codec {
+	for _, name := range dialer {
+		for _, other := range listener {
+			if name == other {
+				if c := lookupCodec(name); c != nil {
+					return c
+				}
+			}
+		}
+	}
+	return nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Name() string {
+	return "snappy"
+}
+
+func (snappyCodec) Compress(data []byte) []byte {
+	return snappy.Encode(nil, data)
+}
+
+func (snappyCodec) Decompress(data []byte, max uint32) ([]byte, error) {
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadCompression, err)
+	}
+	if uint64(n) > uint64(max) {
+		return nil, fmt.Errorf("%w: decompressed size %d, limit %d", errMsgTooLarge, n, max)
+	}
+	out, err := snappy.Decode(nil, data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadCompression, err)
+	}
+	return out, nil
+}
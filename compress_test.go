@@ -0,0 +1,70 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"github.com/golang/snappy"
+	"testing"
+)
+
+func TestSnappyCodec(t *testing.T) {
+	c := lookupCodec("snappy")
+	data := bytes.Repeat([]byte("xlibp2p "), 1024)
+	z := c.Compress(data)
+	if len(z) >= len(data) {
+		t.Fatalf("got compressed size: %d, want less than: %d", len(z), len(data))
+	}
+	got, err := c.Decompress(z, uint32(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("got different data after decompression")
+	}
+	// the decompressed size is checked before decoding
+	bomb := snappy.Encode(nil, make([]byte, 1<<20))
+	if _, err = c.Decompress(bomb, 1<<10); !errors.Is(err, errMsgTooLarge) {
+		t.Fatalf("got err: %v, want: %v", err, errMsgTooLarge)
+	}
+	if _, err = c.Decompress([]byte{0xff, 0xff, 0xff}, 1<<10); !errors.Is(err, errBadCompression) {
+		t.Fatalf("got err: %v, want: %v", err, errBadCompression)
+	}
+}
+
+type testCodec struct {
+	name string
+}
+
+func (c testCodec) Name() string                { return c.name }
+func (c testCodec) Compress(data []byte) []byte { return data }
+func (c testCodec) Decompress(data []byte, max uint32) ([]byte, error) {
+	return data, nil
+}
+
+func TestNegotiateCodec(t *testing.T) {
+	if err := RegisterCodec(testCodec{"test"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterCodec(testCodec{""}); err == nil {
+		t.Fatal("registered codec without name")
+	}
+	tests := []struct {
+		dialer, listener []string
+		want             string
+	}{
+		{[]string{"snappy", "test"}, []string{"test", "snappy"}, "snappy"},
+		{[]string{"test", "snappy"}, []string{"snappy", "test"}, "test"},
+		{[]string{"zstd", "test"}, []string{"zstd", "test"}, "test"},
+		{[]string{"snappy"}, []string{"test"}, ""},
+		{nil, []string{"snappy"}, ""},
+	}
+	for i, test := range tests {
+		got := ""
+		if c := negotiateCodec(test.dialer, test.listener); c != nil {
+			got = c.Name()
+		}
+		if got != test.want {
+			t.Fatalf("test %d got codec: %q, want: %q", i, got, test.want)
+		}
+	}
+}
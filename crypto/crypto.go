@@ -6,6 +6,7 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/x509"
+	"errors"
 	"github.com/xfs-network/xlibp2p/common"
 	"github.com/xfs-network/xlibp2p/common/ahash"
 	"github.com/xfs-network/xlibp2p/common/urlsafeb64"
@@ -89,3 +90,21 @@ func ByteHash256(raw []byte) common.Hash {
 	h := ahash.SHA256(raw)
 	return common.Bytes2Hash(h)
 }
+
+// SharedSecret computes the ECDH shared secret between the local private key
+// and the remote public key. The secret is the x coordinate of the resulting
+// point, left-padded to the byte size of the curve.
+func SharedSecret(prv *ecdsa.PrivateKey, pub *ecdsa.PublicKey) ([]byte, error) {
+	if prv == nil || pub == nil || pub.X == nil || pub.Y == nil {
+		return nil, errors.New("invalid key")
+	}
+	if !prv.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("public key not on curve")
+	}
+	x, _ := prv.Curve.ScalarMult(pub.X, pub.Y, prv.D.Bytes())
+	if x == nil || x.Sign() == 0 {
+		return nil, errors.New("shared secret is infinity")
+	}
+	buf := make([]byte, (prv.Curve.Params().BitSize+7)/8)
+	return x.FillBytes(buf), nil
+}
@@ -57,6 +57,9 @@ func VerifySignatureFromHex(data []byte, sigHex string) bool {
 	return VerifySignature(data, sigBytes)
 }
 func VerifySignature(data []byte, sig []byte) bool {
+	if !validSignatureLen(sig) {
+		return false
+	}
 	totalLen := sig[0]
 	sigAll := sig[1 : totalLen+1]
 	sigBuf := bytes.NewBuffer(sigAll)
@@ -90,6 +93,9 @@ func VerifySignature(data []byte, sig []byte) bool {
 }
 
 func VerifySignatureByPublic(data []byte, sig []byte, pub *ecdsa.PublicKey) bool {
+	if !validSignatureLen(sig) || pub == nil {
+		return false
+	}
 	totalLen := sig[0]
 	sigAll := sig[1 : totalLen+1]
 	sigBuf := bytes.NewBuffer(sigAll)
@@ -108,6 +114,9 @@ func VerifySignatureByPublic(data []byte, sig []byte, pub *ecdsa.PublicKey) bool
 }
 
 func ParsePubKeyFromSignature(sig []byte) (ecdsa.PublicKey, error) {
+	if !validSignatureLen(sig) {
+		return ecdsa.PublicKey{}, errors.New("invalid signature length")
+	}
 	totalLen := sig[0]
 	sigAll := sig[1 : totalLen+1]
 	sigBuf := bytes.NewBuffer(sigAll)
@@ -137,3 +146,9 @@ func ParsePubKeyFromSignature(sig []byte) (ecdsa.PublicKey, error) {
 		Y:     y,
 	}, nil
 }
+
+// validSignatureLen reports whether sig is long enough to hold
+// the length prefixed payload it announces.
+func validSignatureLen(sig []byte) bool {
+	return len(sig) > 0 && int(sig[0])+1 <= len(sig)
+}
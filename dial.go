@@ -3,6 +3,7 @@ package p2p
 import (
 	"bytes"
 	"container/heap"
+	"context"
 	"crypto/rand"
 	"github.com/xfs-network/xlibp2p/discover"
 	"net"
@@ -16,6 +17,9 @@ const (
 	// Discovery lookups are throttled and can only run
 	// once every few seconds.
 	lookupInterval = 4 * time.Second
+
+	// defaultDialTimeout bounds the time spent on connecting to a node.
+	defaultDialTimeout = 15 * time.Second
 )
 
 type task interface {
@@ -28,15 +32,50 @@ type dialtask struct {
 }
 
 func (t *dialtask) Do(srv *server) {
-	tcpAddr := t.dest.TcpAddr()
-	coon, err := net.Dial("tcp", tcpAddr.String())
+	coon, err := t.dial(srv)
+	if err == errNotPermitted {
+		srv.metrics().Counter("p2p_dials_total", "result", "restricted").Inc()
+		return
+	}
 	if err != nil {
+		srv.metrics().Counter("p2p_dials_total", "result", "dial_error").Inc()
 		return
 	}
 	id := t.dest.ID
 	c := srv.newPeerConn(coon, t.flag, &id)
-	c.serve()
+	if err = c.serve(); err != nil {
+		srv.metrics().Counter("p2p_dials_total", "result", "handshake_error").Inc()
+		return
+	}
+	srv.metrics().Counter("p2p_dials_total", "result", "success").Inc()
 }
+
+// dial connects to the addresses of the destination in order and returns
+// the first connection, so nodes reachable on one address family only
+// are still found.
+func (t *dialtask) dial(srv *server) (net.Conn, error) {
+	err := errNotPermitted
+	for _, addr := range t.dest.TcpAddrs() {
+		if !srv.config.NetRestrict.Permits(addr.IP) {
+			continue
+		}
+		var coon net.Conn
+		if coon, err = t.dialAddr(srv, addr); err == nil {
+			return coon, nil
+		}
+		srv.logger.Debugf("dial %s at %s err: %v", t.dest.ID, addr, err)
+	}
+	return nil, err
+}
+
+func (t *dialtask) dialAddr(srv *server, addr *net.TCPAddr) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultDialTimeout)
+	defer cancel()
+	ctx, stop := srv.closeContext(ctx)
+	defer stop()
+	return srv.transport().Dial(ctx, addr.String())
+}
+
 type discoverTask struct {
 	bootstrap bool
 	result  []*discover.Node
@@ -44,25 +83,34 @@ type discoverTask struct {
 
 
 func (t *discoverTask) Do(srv *server) {
+	ctx, cancel := srv.closeContext(context.Background())
+	defer cancel()
 	if t.bootstrap {
-		srv.table.Bootstrap(srv.config.BootstrapNodes)
+		srv.table.BootstrapContext(ctx, srv.config.BootstrapNodes)
 		return
 	}
 	next := srv.lastLookup.Add(lookupInterval)
 	if now := time.Now(); now.Before(next) {
-		time.Sleep(next.Sub(now))
+		select {
+		case <-time.After(next.Sub(now)):
+		case <-srv.close:
+			return
+		}
 	}
 	srv.lastLookup = time.Now()
 	var target discover.NodeId
 	_, _ = rand.Read(target[:])
-	t.result = srv.table.Lookup(target)
+	t.result = srv.table.LookupContext(ctx, target)
 }
 type waitExpireTask struct {
 	time.Duration
 }
 
-func (t waitExpireTask) Do(_ *server) {
-	time.Sleep(t.Duration)
+func (t waitExpireTask) Do(srv *server) {
+	select {
+	case <-time.After(t.Duration):
+	case <-srv.close:
+	}
 }
 
 type dialHistory []pastDial
@@ -110,6 +158,7 @@ type pastDial struct {
 
 
 type dialstate struct {
+	self discover.NodeId
 	static map[discover.NodeId]*discover.Node
 	ntab discoverTable
 	maxDynDials int
@@ -119,6 +168,8 @@ type dialstate struct {
 	bootstrapped  bool
 	randomNodes []*discover.Node
 	hist        *dialHistory
+	// banned reports nodes which must not be dialed, it may be nil.
+	banned func(*discover.Node) bool
 }
 type discoverTable interface {
 	Self() *discover.Node
@@ -128,8 +179,9 @@ type discoverTable interface {
 	ReadRandomNodes([]*discover.Node) int
 }
 
-func newDialState(static []*discover.Node, table discoverTable, maxdyn int) *dialstate {
+func newDialState(self discover.NodeId, static []*discover.Node, table discoverTable, maxdyn int) *dialstate {
 	ds := &dialstate{
+		self: self,
 		ntab: table,
 		maxDynDials: maxdyn,
 		static: make(map[discover.NodeId]*discover.Node),
@@ -155,7 +207,10 @@ func (ds *dialstate) newTasks(nRunning int, peers map[discover.NodeId]Peer, now
 	addDial := func(flag int, n *discover.Node) bool {
 		//the connection established needn't to join the pool
 		_, dialing := ds.dialing[n.ID]
-		if dialing ||  peers[n.ID] != nil || ds.hist.contains(n.ID) {
+		if dialing ||  peers[n.ID] != nil || ds.hist.contains(n.ID) || n.ID == ds.self {
+			return false
+		}
+		if ds.banned != nil && ds.banned(n) {
 			return false
 		}
 		ds.dialing[n.ID] = flag
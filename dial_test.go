@@ -2,11 +2,11 @@ package p2p
 
 import (
 	"crypto/ecdsa"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/discover"
 	"net"
 	"testing"
 	"time"
-	"xlibp2p/crypto"
-	"xlibp2p/discover"
 )
 
 var boots = []string{
@@ -64,9 +64,9 @@ func Test_dialtask_newDialState(t *testing.T) {
 		bootNs = append(bootNs, n)
 	}
 	dynPeers := 10 / 2
-	ds := newDialState(bootNs,newTestTable(t,key),dynPeers)
+	ds := newDialState(discover.PubKey2NodeId(key.PublicKey), bootNs,newTestTable(t,key),dynPeers)
 	ps := make(map[discover.NodeId]Peer)
-	for {
+	for i := 0; i < 3; i++ {
 		now := time.Now()
 		ts := ds.newTasks(1,ps,now)
 		t.Logf("ts len: %d", len(ts))
@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"fmt"
+	"time"
+)
+
+// DiscReason is the reason code sent to the remote side
+// when a peer connection is closed.
+type DiscReason uint8
+
+const (
+	DiscRequested DiscReason = iota
+	DiscNetworkError
+	DiscProtocolError
+	DiscUselessPeer
+	DiscTooManyPeers
+	DiscDuplicateConnection
+	DiscQuitting
+	DiscTimeout
+	DiscSelf
+	DiscBanned
+	DiscSlowPeer
+	DiscQueueOverflow
+)
+
+var discReasonToString = [...]string{
+	DiscRequested:           "disconnect requested",
+	DiscNetworkError:        "network error",
+	DiscProtocolError:       "breach of protocol",
+	DiscUselessPeer:         "useless peer",
+	DiscTooManyPeers:        "too many peers",
+	DiscDuplicateConnection: "duplicate connection",
+	DiscQuitting:            "client quitting",
+	DiscTimeout:             "read timeout",
+	DiscSelf:                "connected to self",
+	DiscBanned:              "peer is banned",
+	DiscSlowPeer:            "peer too slow",
+	DiscQueueOverflow:       "protocol queue overflow",
+}
+
+func (r DiscReason) String() string {
+	if int(r) < len(discReasonToString) {
+		return discReasonToString[r]
+	}
+	return fmt.Sprintf("unknown disconnect reason %d", r)
+}
+
+func (r DiscReason) Error() string {
+	return r.String()
+}
+
+// discWriteTimeout bounds the time spent on sending the disconnect message.
+const discWriteTimeout = time.Second
+
+// discRemoteError is returned by the handshake when the
+// remote side disconnected with a reason.
+type discRemoteError struct {
+	reason DiscReason
+}
+
+func (e *discRemoteError) Error() string {
+	return fmt.Sprintf("disconnected by remote: %v", e.reason)
+}
+
+func decodeDiscReason(data []byte) DiscReason {
+	if len(data) == 0 {
+		return DiscRequested
+	}
+	return DiscReason(data[0])
+}
@@ -0,0 +1,279 @@
+package discover
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// The discovery packets implement rawencode.RawEncoder with a compact
+// binary encoding, all integers are stored by LittleEndian model.
+//
+// endpoint  = ipLen(1byte)+ip(4|16byte)+udp(2byte)+tcp(2byte)
+// ips       = count(1byte)+[ipLen(1byte)+ip(4|16byte)]...
+// ping      = version(4byte)+from(endpoint)+to(endpoint)+expiration(8byte)+[altIPs(ips)]
+// pong      = to(endpoint)+expiration(8byte)+[replyTok(32byte)]
+// findnode  = target(64byte)+expiration(8byte)
+// neighbors = expiration(8byte)+count(2byte)+[endpoint+id(64byte)]...+[altIPs(ips)...]
+//
+// The alternative addresses and the reply token are trailing sections
+// which may be missing, the neighbors packet holds one list for each node
+// in the same order.
+
+var errShortPacketData = errors.New("packet data too short")
+
+// neighborsHeadSize is the size of a neighbors packet without nodes.
+const neighborsHeadSize = 8 + 2
+
+// maxAltIPs is the maximum number of alternative addresses of a node.
+const maxAltIPs = 4
+
+// packetWriter appends encoded fields to a buffer.
+type packetWriter struct {
+	buf []byte
+}
+
+func (w *packetWriter) uint16(n uint16) {
+	var b [2]byte
+	binary.LittleEndian.PutUint16(b[:], n)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *packetWriter) uint32(n uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], n)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *packetWriter) uint64(n uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], n)
+	w.buf = append(w.buf, b[:]...)
+}
+
+func (w *packetWriter) endpoint(ip net.IP, udp, tcp uint16) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	w.buf = append(w.buf, byte(len(ip)))
+	w.buf = append(w.buf, ip...)
+	w.uint16(udp)
+	w.uint16(tcp)
+}
+
+func (w *packetWriter) ip(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	w.buf = append(w.buf, byte(len(ip)))
+	w.buf = append(w.buf, ip...)
+}
+
+func (w *packetWriter) ips(ips []net.IP) {
+	if len(ips) > maxAltIPs {
+		ips = ips[:maxAltIPs]
+	}
+	w.buf = append(w.buf, byte(len(ips)))
+	for _, ip := range ips {
+		w.ip(ip)
+	}
+}
+
+// packetReader reads encoded fields from a buffer, the first error
+// is kept and every following read is a no-op.
+type packetReader struct {
+	buf []byte
+	err error
+}
+
+func (r *packetReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if len(r.buf) < n {
+		r.err = errShortPacketData
+		return nil
+	}
+	b := r.buf[:n]
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *packetReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *packetReader) uint32() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *packetReader) uint64() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.LittleEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *packetReader) ip() net.IP {
+	ipLen := r.next(1)
+	if ipLen == nil {
+		return nil
+	}
+	if ipLen[0] != net.IPv4len && ipLen[0] != net.IPv6len {
+		r.err = errors.New("invalid ip length")
+		return nil
+	}
+	if b := r.next(int(ipLen[0])); b != nil {
+		return append(net.IP{}, b...)
+	}
+	return nil
+}
+
+func (r *packetReader) endpoint() (ip net.IP, udp, tcp uint16) {
+	ip = r.ip()
+	udp = r.uint16()
+	tcp = r.uint16()
+	return ip, udp, tcp
+}
+
+// more reports whether an optional trailing section follows.
+func (r *packetReader) more() bool {
+	return r.err == nil && len(r.buf) > 0
+}
+
+func (r *packetReader) ips() []net.IP {
+	count := r.next(1)
+	if count == nil {
+		return nil
+	}
+	if count[0] > maxAltIPs {
+		r.err = errors.New("too many addresses")
+		return nil
+	}
+	var ips []net.IP
+	for i := 0; i < int(count[0]) && r.err == nil; i++ {
+		ips = append(ips, r.ip())
+	}
+	return ips
+}
+
+func (r *packetReader) nodeId() (id NodeId) {
+	copy(id[:], r.next(len(id)))
+	return id
+}
+
+// rpcNodeSize returns the encoded size of a node in a neighbors packet,
+// including its list of alternative addresses.
+func rpcNodeSize(n rpcNode) int {
+	size := ipSize(n.IP) + 2 + 2 + len(n.ID) + 1
+	for i, ip := range n.AltIPs {
+		if i == maxAltIPs {
+			break
+		}
+		size += ipSize(ip)
+	}
+	return size
+}
+
+func ipSize(ip net.IP) int {
+	if ip.To4() != nil {
+		return 1 + net.IPv4len
+	}
+	return 1 + net.IPv6len
+}
+
+func (req *ping) Encode() ([]byte, error) {
+	w := new(packetWriter)
+	w.uint32(uint32(req.Version))
+	w.endpoint(req.From.IP, req.From.UDP, req.From.TCP)
+	w.endpoint(req.To.IP, req.To.UDP, req.To.TCP)
+	w.uint64(req.Expiration)
+	if len(req.AltIPs) > 0 {
+		w.ips(req.AltIPs)
+	}
+	return w.buf, nil
+}
+
+func (req *ping) Decode(data []byte) error {
+	r := &packetReader{buf: data}
+	req.Version = int(r.uint32())
+	req.From.IP, req.From.UDP, req.From.TCP = r.endpoint()
+	req.To.IP, req.To.UDP, req.To.TCP = r.endpoint()
+	req.Expiration = r.uint64()
+	if r.more() {
+		req.AltIPs = r.ips()
+	}
+	return r.err
+}
+
+func (req *pong) Encode() ([]byte, error) {
+	w := new(packetWriter)
+	w.endpoint(req.To.IP, req.To.UDP, req.To.TCP)
+	w.uint64(req.Expiration)
+	if len(req.ReplyTok) > 0 {
+		w.buf = append(w.buf, req.ReplyTok...)
+	}
+	return w.buf, nil
+}
+
+func (req *pong) Decode(data []byte) error {
+	r := &packetReader{buf: data}
+	req.To.IP, req.To.UDP, req.To.TCP = r.endpoint()
+	req.Expiration = r.uint64()
+	if r.more() {
+		req.ReplyTok = append([]byte{}, r.next(macSize)...)
+	}
+	return r.err
+}
+
+func (req *findnode) Encode() ([]byte, error) {
+	w := &packetWriter{buf: append([]byte{}, req.Target[:]...)}
+	w.uint64(req.Expiration)
+	return w.buf, nil
+}
+
+func (req *findnode) Decode(data []byte) error {
+	r := &packetReader{buf: data}
+	req.Target = r.nodeId()
+	req.Expiration = r.uint64()
+	return r.err
+}
+
+func (req *neighbors) Encode() ([]byte, error) {
+	w := new(packetWriter)
+	w.uint64(req.Expiration)
+	w.uint16(uint16(len(req.Nodes)))
+	for _, n := range req.Nodes {
+		w.endpoint(n.IP, n.UDP, n.TCP)
+		w.buf = append(w.buf, n.ID[:]...)
+	}
+	for _, n := range req.Nodes {
+		w.ips(n.AltIPs)
+	}
+	return w.buf, nil
+}
+
+func (req *neighbors) Decode(data []byte) error {
+	r := &packetReader{buf: data}
+	req.Expiration = r.uint64()
+	count := int(r.uint16())
+	req.Nodes = make([]rpcNode, 0)
+	for i := 0; i < count && r.err == nil; i++ {
+		var n rpcNode
+		n.IP, n.UDP, n.TCP = r.endpoint()
+		n.ID = r.nodeId()
+		req.Nodes = append(req.Nodes, n)
+	}
+	if r.more() {
+		for i := range req.Nodes {
+			req.Nodes[i].AltIPs = r.ips()
+		}
+	}
+	return r.err
+}
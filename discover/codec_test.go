@@ -0,0 +1,75 @@
+package discover
+
+import (
+	"bytes"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCodec_roundTrip(t *testing.T) {
+	exp := uint64(time.Now().Add(expiration).Unix())
+	v4 := rpcEndpoint{IP: net.IP{127, 0, 0, 1}, UDP: 9001, TCP: 9002}
+	v6 := rpcEndpoint{IP: net.ParseIP("2001:db8::1"), UDP: 9003, TCP: 9004}
+	tests := []struct {
+		in  interface{ Encode() ([]byte, error) }
+		out interface{ Decode([]byte) error }
+	}{
+		{&ping{Version: Version, From: v4, To: v6, Expiration: exp}, new(ping)},
+		{&ping{Version: Version, From: v4, To: v6, Expiration: exp, AltIPs: []net.IP{v6.IP}}, new(ping)},
+		{&pong{To: v6, Expiration: exp}, new(pong)},
+		{&pong{To: v6, Expiration: exp, ReplyTok: bytes.Repeat([]byte{1}, macSize)}, new(pong)},
+		{&findnode{Target: NodeId{1, 2, 3}, Expiration: exp}, new(findnode)},
+		{&neighbors{Expiration: exp, Nodes: []rpcNode{
+			{IP: v4.IP, UDP: v4.UDP, TCP: v4.TCP, ID: NodeId{4, 5}},
+			{IP: v6.IP, UDP: v6.UDP, TCP: v6.TCP, ID: NodeId{6, 7}, AltIPs: []net.IP{v4.IP, v6.IP}},
+		}}, new(neighbors)},
+	}
+	for _, test := range tests {
+		data, err := test.in.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = test.out.Decode(data); err != nil {
+			t.Fatalf("decode %T err: %v", test.in, err)
+		}
+		if !reflect.DeepEqual(test.in, test.out) {
+			t.Fatalf("got %+v, want: %+v", test.out, test.in)
+		}
+		if err = test.out.Decode(data[:len(data)-1]); err != errShortPacketData {
+			t.Fatalf("decode truncated %T got err: %v, want: %v", test.in, err, errShortPacketData)
+		}
+	}
+}
+
+func TestCodec_neighborsPacketSize(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &neighbors{Expiration: uint64(time.Now().Add(expiration).Unix())}
+	n := rpcNode{IP: net.ParseIP("2001:db8::1"), UDP: 9001, TCP: 9002}
+	for size := 0; size+rpcNodeSize(n) <= maxNeighborsSize; size += rpcNodeSize(n) {
+		p.Nodes = append(p.Nodes, n)
+	}
+	raw, err := encodePacket(key, neighborsPacket, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) > maxPacketSize {
+		t.Fatalf("got packet size: %d, want at most: %d", len(raw), maxPacketSize)
+	}
+	pack, _, err := decodePacket(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(pack.(*neighbors).Nodes); got != len(p.Nodes) {
+		t.Fatalf("got nodes: %d, want: %d", got, len(p.Nodes))
+	}
+	p.Nodes = append(p.Nodes, n)
+	if _, err = encodePacket(key, neighborsPacket, p); err != errPacketTooBig {
+		t.Fatalf("got err: %v, want: %v", err, errPacketTooBig)
+	}
+}
@@ -2,11 +2,13 @@ package discover
 
 import (
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/xfs-network/xlibp2p/common"
 	"github.com/xfs-network/xlibp2p/crypto"
+	"math/big"
 	"net"
 	"net/url"
 	"strconv"
@@ -43,14 +45,40 @@ func MustHex2NodeId(in string) NodeId {
 	}
 	return id
 }
+// PubKey2NodeId returns the node ID of the given public key. The ID holds
+// the X and Y coordinates of the key, each left-padded to half of the ID.
 func PubKey2NodeId(pub ecdsa.PublicKey) NodeId {
 	var id NodeId
-	pHashBytes := crypto.PubKeyEncode(pub)
-	copy(id[:], pHashBytes)
+	half := len(id) / 2
+	if pub.X == nil || pub.Y == nil ||
+		pub.X.BitLen() > half*8 || pub.Y.BitLen() > half*8 {
+		return id
+	}
+	pub.X.FillBytes(id[:half])
+	pub.Y.FillBytes(id[half:])
 	return id
 }
+
+// PubKey returns the P-256 public key the node ID was derived from.
+// An error is returned if the ID is not a point on the curve.
+func (id NodeId) PubKey() (*ecdsa.PublicKey, error) {
+	half := len(id) / 2
+	pub := &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(id[:half]),
+		Y:     new(big.Int).SetBytes(id[half:]),
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, errors.New("node id is not a valid public key")
+	}
+	return pub, nil
+}
 type Node struct {
 	IP net.IP
+	// AltIPs are further addresses of a node which listens on several
+	// networks, e.g. the IPv6 address of a dual-stack node. They use the
+	// same ports as IP.
+	AltIPs []net.IP `json:",omitempty"`
 	TCP,UDP uint16
 	ID NodeId
 	Hash common.Hash
@@ -73,6 +101,23 @@ func (n *Node) TcpAddr() *net.TCPAddr {
 	return &net.TCPAddr{IP: n.IP, Port: int(n.TCP)}
 }
 
+// TcpAddrs returns the TCP addresses of all IPs of the node, IP first.
+func (n *Node) TcpAddrs() []*net.TCPAddr {
+	addrs := []*net.TCPAddr{n.TcpAddr()}
+	for _, ip := range n.AltIPs {
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: int(n.TCP)})
+	}
+	return addrs
+}
+
+// normIP returns IPv4 addresses in their 4 byte form.
+func normIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
 func (n *Node) UdpAddr() *net.UDPAddr {
 	return n.addr()
 }
@@ -87,7 +132,12 @@ func (n *Node) String() string {
 		Scheme: "xfsnode",
 		Host:   addr.String(),
 	}
-	u.RawQuery = fmt.Sprintf("id=%x", n.ID[:])
+	q := url.Values{}
+	q.Set("id", fmt.Sprintf("%x", n.ID[:]))
+	for _, ip := range n.AltIPs {
+		q.Add("addr", ip.String())
+	}
+	u.RawQuery = q.Encode()
 	return u.String()
 }
 
@@ -111,9 +161,7 @@ func ParseNode(rawurl string) (*Node, error) {
 	if ip = net.ParseIP(host); ip == nil {
 		return nil, errors.New("invalid ip host")
 	}
-	if ipv4 := ip.To4(); ipv4 != nil {
-		ip = ipv4
-	}
+	ip = normIP(ip)
 	if tcpPort, err = strconv.ParseUint(port, 10, 16); err != nil {
 		return nil, errors.New("invalid port")
 	}
@@ -126,17 +174,30 @@ func ParseNode(rawurl string) (*Node, error) {
 	if id, err = Hex2NodeId(nId); err != nil {
 		return nil, fmt.Errorf("invalid node ID (%v)", err)
 	}
-	return newNode(ip, uint16(tcpPort), uint16(udpPort), id), nil
+	n := newNode(ip, uint16(tcpPort), uint16(udpPort), id)
+	for _, item := range q["addr"] {
+		alt := net.ParseIP(item)
+		if alt == nil {
+			return nil, fmt.Errorf("invalid addr: %s", item)
+		}
+		n.AltIPs = append(n.AltIPs, normIP(alt))
+	}
+	return n, nil
 }
 
 
 
 // recoverNodeID computes the public key used to sign the
 // given hash from the signature.
-func recoverNodeID(buf []byte) (NodeId, error) {
-	var id NodeId
-	copy(id[:], buf)
-	return id, nil
+func recoverNodeID(hash, sig []byte) (NodeId, error) {
+	pub, err := crypto.ParsePubKeyFromSignature(sig)
+	if err != nil {
+		return NodeId{}, err
+	}
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) || !crypto.VerifySignatureByPublic(hash, sig, &pub) {
+		return NodeId{}, errBadSignature
+	}
+	return PubKey2NodeId(pub), nil
 }
 var lzcount = [256]int{
 	8, 7, 6, 6, 5, 5, 5, 5,
@@ -18,11 +18,20 @@ func TestPubKey2NodeId(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	wantBuf := crypto.PubKeyEncode(key.PublicKey)
+	wantBuf := make([]byte, nodeIdLen)
+	key.PublicKey.X.FillBytes(wantBuf[:nodeIdLen/2])
+	key.PublicKey.Y.FillBytes(wantBuf[nodeIdLen/2:])
 	gotId := PubKey2NodeId(key.PublicKey)
 	if !bytes.Equal(wantBuf,gotId[:]){
 		t.Fatalf("got id: %s, want: %x", gotId, wantBuf)
 	}
+	pub, err := gotId.PubKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub.X.Cmp(key.PublicKey.X) != 0 || pub.Y.Cmp(key.PublicKey.Y) != 0 {
+		t.Fatalf("got public key: %x%x, want: %x", pub.X, pub.Y, wantBuf)
+	}
 }
 
 func TestHex2NodeId(t *testing.T) {
@@ -169,4 +178,23 @@ func TestParseNode2(t *testing.T) {
 		t.Fatal(err)
 	}
 	_=n
-}
\ No newline at end of file
+}
+func TestNode_altIPsString(t *testing.T) {
+	n := newNode(net.IP{127, 0, 0, 1}, 9091, 9091, NodeId{1, 2, 3})
+	n.AltIPs = []net.IP{net.ParseIP("2001:db8::1"), {10, 0, 0, 1}}
+	got, err := ParseNode(n.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.AltIPs) != len(n.AltIPs) {
+		t.Fatalf("got alt ips: %v, want: %v", got.AltIPs, n.AltIPs)
+	}
+	for i, ip := range n.AltIPs {
+		if !got.AltIPs[i].Equal(ip) {
+			t.Fatalf("got alt ips: %v, want: %v", got.AltIPs, n.AltIPs)
+		}
+	}
+	if addrs := got.TcpAddrs(); len(addrs) != 3 || addrs[1].Port != 9091 {
+		t.Fatalf("got tcp addrs: %v", addrs)
+	}
+}
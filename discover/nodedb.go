@@ -6,6 +6,7 @@ import (
 	"github.com/xfs-network/xlibp2p/common/rawencode"
 	"github.com/xfs-network/xlibp2p/crypto"
 	"github.com/xfs-network/xlibp2p/storage/badger"
+	"net"
 	"sync"
 	"time"
 )
@@ -27,6 +28,8 @@ var (
 	nodeDBDiscoverPing      = nodeDBDiscoverRoot + ":lastping"
 	nodeDBDiscoverPong      = nodeDBDiscoverRoot + ":lastpong"
 	nodeDBDiscoverFindFails = nodeDBDiscoverRoot + ":findfail"
+	// bans are kept apart from the node items, they outlive expired nodes.
+	nodeDBBanPrefix = []byte("b:")
 )
 
 func newNodeDB(path string, version uint32, self NodeId) (*nodeDB, error) {
@@ -237,3 +240,54 @@ func (db *nodeDB) querySeeds(n int) []*Node {
 	return nodes
 }
 
+// Ban is a node which may not be contacted until the ban expires.
+type Ban struct {
+	ID NodeId
+	// IP is the address the node was connected from, it may be nil.
+	IP    net.IP
+	Until time.Time
+}
+
+// updateBan inserts - potentially overwriting - a ban into the database.
+func (db *nodeDB) updateBan(b Ban) error {
+	blob, err := rawencode.Encode(&b)
+	if err != nil {
+		return err
+	}
+	return db.storage.SetData(append(nodeDBBanPrefix, b.ID[:]...), blob)
+}
+
+// banned reports whether the node is banned at the given time.
+func (db *nodeDB) banned(id NodeId, now time.Time) bool {
+	blob, err := db.storage.GetData(append(nodeDBBanPrefix, id[:]...))
+	if err != nil {
+		return false
+	}
+	var b Ban
+	if err = rawencode.Decode(blob, &b); err != nil {
+		return false
+	}
+	return now.Before(b.Until)
+}
+
+// bans returns the bans which have not expired at the given time,
+// expired ones are deleted.
+func (db *nodeDB) bans(now time.Time) []Ban {
+	var (
+		bans    []Ban
+		expired [][]byte
+	)
+	_ = db.storage.PrefixForeachData(nodeDBBanPrefix, func(k []byte, v []byte) error {
+		var b Ban
+		if err := rawencode.Decode(v, &b); err != nil || !now.Before(b.Until) {
+			expired = append(expired, append([]byte{}, k...))
+			return nil
+		}
+		bans = append(bans, b)
+		return nil
+	})
+	for _, k := range expired {
+		_ = db.storage.DelData(k)
+	}
+	return bans
+}
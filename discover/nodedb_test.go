@@ -205,4 +205,35 @@ func TestNodeDB_ensureExpire(t *testing.T) {
 	if n == nil {
 		t.Fatal("expected value not met, nodes[1] is nil")
 	}
-}
\ No newline at end of file
+}
+func TestNodeDB_bans(t *testing.T) {
+	path := t.TempDir()
+	db, err := newNodeDB(path, Version, NodeId{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	active := Ban{ID: nodes[0].ID, IP: net.IP{10, 0, 0, 1}, Until: now.Add(time.Hour)}
+	expired := Ban{ID: nodes[1].ID, Until: now.Add(-time.Second)}
+	for _, b := range []Ban{active, expired} {
+		if err = db.updateBan(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !db.banned(active.ID, now) || db.banned(expired.ID, now) || db.banned(nodes[2].ID, now) {
+		t.Fatal("got wrong banned state")
+	}
+	db.close()
+	// the bans outlive a restart, expired ones are dropped
+	if db, err = newNodeDB(path, Version, NodeId{}); err != nil {
+		t.Fatal(err)
+	}
+	defer db.close()
+	bans := db.bans(now)
+	if len(bans) != 1 || bans[0].ID != active.ID || !bans[0].IP.Equal(active.IP) || !bans[0].Until.Equal(active.Until) {
+		t.Fatalf("got bans: %+v, want: [%+v]", bans, active)
+	}
+	if db.banned(expired.ID, now.Add(-time.Minute)) {
+		t.Fatal("expired ban not deleted")
+	}
+}
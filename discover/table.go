@@ -1,6 +1,7 @@
 package discover
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/binary"
 	"github.com/xfs-network/xlibp2p/common"
@@ -30,8 +31,14 @@ type Table struct {
 	bondmu    sync.Mutex
 	bonding   map[NodeId]*bondproc
 	bondslots chan struct{} // limits total number of active bonding processes
+	// bonding processes are shared by all callers, so they run with
+	// the lifetime of the table instead of the context of a caller.
+	bondctx    context.Context
+	bondcancel context.CancelFunc
+	bondwg     sync.WaitGroup
 
-	nodeAddedHook func(*Node) // for testing
+	nodeAddedHook   func(*Node) // called with mu held
+	nodeRemovedHook func(*Node) // called with mu held
 
 	net  transport
 	self *Node // metadata of the local node
@@ -47,9 +54,12 @@ type bondproc struct {
 // it is an interface so we can test without opening lots of UDP
 // sockets and without generating a private key.
 type transport interface {
-	ping(NodeId, *net.UDPAddr) error
-	waitping(NodeId) error
-	findnode(toid NodeId, addr *net.UDPAddr, target NodeId) ([]*Node, error)
+	ping(context.Context, NodeId, *net.UDPAddr) error
+	// verify is a ping which only succeeds if the pong proves that the
+	// ping reached the address.
+	verify(context.Context, NodeId, *net.UDPAddr) error
+	waitping(context.Context, NodeId) error
+	findnode(ctx context.Context, toid NodeId, addr *net.UDPAddr, target NodeId) ([]*Node, error)
 	close()
 }
 
@@ -74,6 +84,7 @@ func newTable(t transport, ourID NodeId, ourAddr *net.UDPAddr, nodeDBPath string
 		bonding:   make(map[NodeId]*bondproc),
 		bondslots: make(chan struct{}, maxBondingPingPongs),
 	}
+	tab.bondctx, tab.bondcancel = context.WithCancel(context.Background())
 	for i := 0; i < cap(tab.bondslots); i++ {
 		tab.bondslots <- struct{}{}
 	}
@@ -142,10 +153,34 @@ func randUint(max uint32) uint32 {
 	return binary.BigEndian.Uint32(b[:]) % max
 }
 
+// SetNodeHooks sets the functions called when a node is added to or
+// removed from the table. The hooks are called with the table lock held
+// and must not call back into the table.
+func (tab *Table) SetNodeHooks(added, removed func(*Node)) {
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+	tab.nodeAddedHook = added
+	tab.nodeRemovedHook = removed
+}
+
+// Ban stores the ban of a node in the node database. The node is removed
+// from the table and no bond is made with it until the ban expires.
+func (tab *Table) Ban(b Ban) error {
+	tab.del(&Node{ID: b.ID, Hash: crypto.ByteHash256(b.ID[:])})
+	return tab.db.updateBan(b)
+}
+
+// Bans returns the bans in the node database which have not expired.
+func (tab *Table) Bans() []Ban {
+	return tab.db.bans(time.Now())
+}
+
 // Close terminates the network listener and flushes the node database.
 func (tab *Table) Close() {
-	tab.db.close()
+	tab.bondcancel()
 	tab.net.close()
+	tab.bondwg.Wait()
+	tab.db.close()
 }
 
 // Bootstrap sets the bootstrap nodes. These nodes are used to connect
@@ -153,6 +188,12 @@ func (tab *Table) Close() {
 // fill the table by performing random lookup operations on the
 // network.
 func (tab *Table) Bootstrap(nodes []*Node) {
+	tab.BootstrapContext(context.Background(), nodes)
+}
+
+// BootstrapContext is like Bootstrap, the initial lookups are
+// abandoned once ctx is done.
+func (tab *Table) BootstrapContext(ctx context.Context, nodes []*Node) {
 	tab.mu.Lock()
 	// TODO: maybe filter nodes with bad fields (nil, etc.) to avoid strange crashes
 	tab.nursery = make([]*Node, 0, len(nodes))
@@ -162,7 +203,7 @@ func (tab *Table) Bootstrap(nodes []*Node) {
 		tab.nursery = append(tab.nursery, &cpy)
 	}
 	tab.mu.Unlock()
-	tab.refresh()
+	tab.refresh(ctx)
 }
 
 // Lookup performs a network search for nodes close
@@ -171,6 +212,12 @@ func (tab *Table) Bootstrap(nodes []*Node) {
 // The given target does not need to be an actual node
 // identifier.
 func (tab *Table) Lookup(targetID NodeId) []*Node {
+	return tab.LookupContext(context.Background(), targetID)
+}
+
+// LookupContext is like Lookup but stops querying once ctx is done,
+// the closest nodes found until then are returned.
+func (tab *Table) LookupContext(ctx context.Context, targetID NodeId) []*Node {
 	var (
 		target = crypto.ByteHash256(targetID[:])
 		asked = make(map[NodeId]bool)
@@ -194,7 +241,7 @@ func (tab *Table) Lookup(targetID NodeId) []*Node {
 	// If the result set is empty, all nodes were dropped, refresh
 	if len(result.entries) == 0 {
 		//tab.Logger.Debugf("table lockup: %s not found, try to table refresh", targetID)
-		tab.refresh()
+		tab.refresh(ctx)
 		return nil
 	}
 	//tab.Logger.Debugf("table lockup: %s is exists, update entries", targetID)
@@ -207,8 +254,8 @@ func (tab *Table) Lookup(targetID NodeId) []*Node {
 				pendingQueries++
 				go func() {
 					// Find potential neighbors to bond with
-					r, err := tab.net.findnode(n.ID, n.addr(), targetID)
-					if err != nil {
+					r, err := tab.net.findnode(ctx, n.ID, n.addr(), targetID)
+					if err != nil && ctx.Err() == nil {
 						// Bump the failure counter to detect and evacuate non-bonded entries
 						fails := tab.db.findFails(n.ID) + 1
 						if err = tab.db.updateFindFails(n.ID, fails); err !=nil {
@@ -221,7 +268,7 @@ func (tab *Table) Lookup(targetID NodeId) []*Node {
 							tab.del(n)
 						}
 					}
-					replyCh <- tab.bondall(r)
+					replyCh <- tab.bondall(ctx, r)
 				}()
 			}
 		}
@@ -230,7 +277,14 @@ func (tab *Table) Lookup(targetID NodeId) []*Node {
 			break
 		}
 		// wait for the next reply
-		for _, n := range <-replyCh {
+		var reply []*Node
+		select {
+		case reply = <-replyCh:
+		case <-ctx.Done():
+			// the pending queries fit into replyCh and don't block
+			return result.entries
+		}
+		for _, n := range reply {
 			if n != nil && !seen[n.ID] {
 				seen[n.ID] = true
 				result.push(n, bucketSize)
@@ -243,7 +297,7 @@ func (tab *Table) Lookup(targetID NodeId) []*Node {
 
 // refresh performs a lookup for a random target to keep buckets full, or seeds
 // the table if it is empty (initial bootstrap or discarded faulty peers).
-func (tab *Table) refresh() {
+func (tab *Table) refresh(ctx context.Context) {
 	seed := true
 
 	// If the discovery table is empty, seed with previously known nodes
@@ -272,7 +326,7 @@ func (tab *Table) refresh() {
 			return
 		}
 		//tab.Logger.Debugf("refresh table is not empty, try to lookup radmon node id: %s", target)
-		result := tab.Lookup(target)
+		result := tab.LookupContext(ctx, target)
 		//tab.Logger.Debugf("refresh table lookup node id: %s, result len: %d", target, len(result))
 		if len(result) == 0 {
 			// Lookup failed, seed after all
@@ -289,9 +343,9 @@ func (tab *Table) refresh() {
 		//}
 		nodes := append(tab.nursery, seeds...)
 		// Bond with all the seed nodes (will pingpong only if failed recently)
-		bonded := tab.bondall(nodes)
+		bonded := tab.bondall(ctx, nodes)
 		if len(bonded) > 0 {
-			tab.Lookup(tab.self.ID)
+			tab.LookupContext(ctx, tab.self.ID)
 		}
 		// TODO: the Kademlia paper says that we're supposed to perform
 		// random lookups in all buckets further away than our closest neighbor.
@@ -322,11 +376,11 @@ func (tab *Table) len() (n int) {
 
 // bondall bonds with all given nodes concurrently and returns
 // those nodes for which bonding has probably succeeded.
-func (tab *Table) bondall(nodes []*Node) (result []*Node) {
+func (tab *Table) bondall(ctx context.Context, nodes []*Node) (result []*Node) {
 	rc := make(chan *Node, len(nodes))
 	for i := range nodes {
 		go func(n *Node) {
-			nn, _ := tab.bond(false, n.ID, n.addr(), uint16(n.TCP))
+			nn, _ := tab.bond(ctx, false, n.ID, n.addr(), uint16(n.TCP), n.AltIPs)
 			rc <- nn
 		}(nodes[i])
 	}
@@ -354,7 +408,10 @@ func (tab *Table) bondall(nodes []*Node) (result []*Node) {
 //
 // If pinged is true, the remote node has just pinged us and one half
 // of the process can be skipped.
-func (tab *Table) bond(pinged bool, id NodeId, addr *net.UDPAddr, tcpPort uint16) (*Node, error) {
+func (tab *Table) bond(ctx context.Context, pinged bool, id NodeId, addr *net.UDPAddr, tcpPort uint16, altIPs []net.IP) (*Node, error) {
+	if tab.db.banned(id, time.Now()) {
+		return nil, errBanned
+	}
 	// Retrieve a previously known node and any recent findnode failures
 	node, fails := tab.db.node(id), 0
 	if node != nil {
@@ -366,23 +423,29 @@ func (tab *Table) bond(pinged bool, id NodeId, addr *net.UDPAddr, tcpPort uint16
 	if node == nil || fails > 0 {
 		tab.bondmu.Lock()
 		w := tab.bonding[id]
-		if w != nil {
-			//tab.Logger.Debugf("table bond node by id: %s is bonding, wait for result",id)
-			// Wait for an existing bonding process to complete.
-			tab.bondmu.Unlock()
-			<-w.done
-		} else {
+		if w == nil {
 			// Register a new bonding process.
 			w = &bondproc{done: make(chan struct{})}
 			tab.bonding[id] = w
 			//tab.Logger.Debugf("table bond append id: %s to bonding, and try pingpong", id)
-			tab.bondmu.Unlock()
-			// Do the ping/pong. The result goes into w.
-			tab.pingpong(w, pinged, id, addr, tcpPort)
-			// Unregister the process after it's done.
-			tab.bondmu.Lock()
-			delete(tab.bonding, id)
-			tab.bondmu.Unlock()
+			tab.bondwg.Add(1)
+			go func() {
+				defer tab.bondwg.Done()
+				// Do the ping/pong. The result goes into w.
+				tab.pingpong(tab.bondctx, w, pinged, id, addr, tcpPort, altIPs)
+				// Unregister the process after it's done.
+				tab.bondmu.Lock()
+				delete(tab.bonding, id)
+				tab.bondmu.Unlock()
+			}()
+		}
+		tab.bondmu.Unlock()
+		// Wait for the bonding process to complete, each caller
+		// only gives up on its own context.
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 		// Retrieve the bonding results
 		result = w.err
@@ -401,7 +464,7 @@ func (tab *Table) bond(pinged bool, id NodeId, addr *net.UDPAddr, tcpPort uint16
 		b := tab.buckets[bucketsIndex]
 		//tab.Logger.Debugf("bond target id: %s, get buckets by index: %d", id, bucketsIndex)
 		if !b.bump(node) {
-			tab.pingreplace(node, b)
+			tab.pingreplace(ctx, node, b)
 		}
 		if err := tab.db.updateFindFails(id, 0); err != nil {
 			//tab.Logger.Warnln("bond updateFindFails err", err)
@@ -410,13 +473,19 @@ func (tab *Table) bond(pinged bool, id NodeId, addr *net.UDPAddr, tcpPort uint16
 	return node, result
 }
 
-func (tab *Table) pingpong(w *bondproc, pinged bool, id NodeId, addr *net.UDPAddr, tcpPort uint16) {
+func (tab *Table) pingpong(ctx context.Context, w *bondproc, pinged bool, id NodeId, addr *net.UDPAddr, tcpPort uint16, altIPs []net.IP) {
 	// Request a bonding slot to limit network usage
 	//tab.Logger.Debugf("table pingpong call, pinged: %v, target id: %s, bondslots: %d", pinged, id, len(tab.bondslots))
-	<-tab.bondslots
+	select {
+	case <-tab.bondslots:
+	case <-ctx.Done():
+		w.err = ctx.Err()
+		close(w.done)
+		return
+	}
 	defer func() { tab.bondslots <- struct{}{} }()
 	// Ping the remote side and wait for a pong
-	if w.err = tab.ping(id, addr); w.err != nil {
+	if w.err = tab.ping(ctx, id, addr); w.err != nil {
 		close(w.done)
 		return
 	}
@@ -429,10 +498,11 @@ func (tab *Table) pingpong(w *bondproc, pinged bool, id NodeId, addr *net.UDPAdd
 		//	close(w.done)
 		//	return
 		//}
-		tab.net.waitping(id)
+		tab.net.waitping(ctx, id)
 	}
 	// Bonding succeeded, update the node database
 	w.n = newNode(addr.IP, uint16(addr.Port), tcpPort, id)
+	w.n.AltIPs = tab.verifyAltIPs(ctx, id, addr, altIPs)
 	//if err := tab.db.updateNode(w.n); err != nil {
 	//	close(w.done)
 	//	return
@@ -441,14 +511,32 @@ func (tab *Table) pingpong(w *bondproc, pinged bool, id NodeId, addr *net.UDPAdd
 	close(w.done)
 }
 
-func (tab *Table) pingreplace(new *Node, b *bucket) {
+// verifyAltIPs returns the announced alternative addresses on which the
+// node answered a ping of its own. Unverified addresses are dropped, the
+// dialer must not be pointed at arbitrary hosts by a signed ping.
+func (tab *Table) verifyAltIPs(ctx context.Context, id NodeId, addr *net.UDPAddr, altIPs []net.IP) []net.IP {
+	var verified []net.IP
+	for _, ip := range altIPs {
+		if ip.Equal(addr.IP) {
+			continue
+		}
+		if err := tab.net.verify(ctx, id, &net.UDPAddr{IP: ip, Port: addr.Port}); err == nil {
+			verified = append(verified, ip)
+		}
+	}
+	return verified
+}
+
+func (tab *Table) pingreplace(ctx context.Context, new *Node, b *bucket) {
+	var removed *Node
 	if len(b.entries) == bucketSize {
 		oldest := b.entries[bucketSize-1]
-		if err := tab.ping(oldest.ID, oldest.addr()); err == nil {
+		if err := tab.ping(ctx, oldest.ID, oldest.addr()); err == nil {
 			//tab.Logger.Debugf("table pingreplace try ping by id: %s success", new.ID)
 			// The node responded, we don't need to replace it.
 			return
 		}
+		removed = oldest
 	} else {
 		// Add a slot at the end so the last entry doesn't
 		// fall off when adding the new node.
@@ -458,6 +546,9 @@ func (tab *Table) pingreplace(new *Node, b *bucket) {
 	copy(b.entries[1:], b.entries)
 	b.entries[0] = new
 	//tab.Logger.Debugf("pingreplace move to the front by id: %s", new)
+	if removed != nil && tab.nodeRemovedHook != nil {
+		tab.nodeRemovedHook(removed)
+	}
 	if tab.nodeAddedHook != nil {
 		tab.nodeAddedHook(new)
 	}
@@ -465,12 +556,12 @@ func (tab *Table) pingreplace(new *Node, b *bucket) {
 
 // ping a remote endpoint and wait for a reply, also updating the node database
 // accordingly.
-func (tab *Table) ping(id NodeId, addr *net.UDPAddr) error {
+func (tab *Table) ping(ctx context.Context, id NodeId, addr *net.UDPAddr) error {
 	// Update the last ping and send the message
 	if err := tab.db.updateLastPing(id, time.Now()); err != nil {
 		return err
 	}
-	if err := tab.net.ping(id, addr); err != nil {
+	if err := tab.net.ping(ctx, id, addr); err != nil {
 		return err
 	}
 	// Pong received, update the database and return
@@ -517,7 +608,11 @@ func (tab *Table) del(node *Node) {
 	bucket := tab.buckets[bucketsIndex]
 	for i := range bucket.entries {
 		if bucket.entries[i].ID == node.ID {
+			removed := bucket.entries[i]
 			bucket.entries = append(bucket.entries[:i], bucket.entries[i+1:]...)
+			if tab.nodeRemovedHook != nil {
+				tab.nodeRemovedHook(removed)
+			}
 			return
 		}
 	}
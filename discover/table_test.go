@@ -2,6 +2,7 @@ package discover
 
 import (
 	"bytes"
+	"context"
 	"net"
 	"sync"
 	"testing"
@@ -16,13 +17,16 @@ type testNet struct {
 	t *testing.T
 	ns []*Node
 }
-func (t *testNet) ping(id NodeId, addr *net.UDPAddr) error {
+func (t *testNet) ping(ctx context.Context, id NodeId, addr *net.UDPAddr) error {
 	return nil
 }
-func (t *testNet) waitping(NodeId) error{
+func (t *testNet) verify(ctx context.Context, id NodeId, addr *net.UDPAddr) error {
 	return nil
 }
-func (t *testNet) findnode(toid NodeId, addr *net.UDPAddr, target NodeId) ([]*Node, error){
+func (t *testNet) waitping(context.Context, NodeId) error{
+	return nil
+}
+func (t *testNet) findnode(ctx context.Context, toid NodeId, addr *net.UDPAddr, target NodeId) ([]*Node, error){
 	return nil,nil
 }
 func (t *testNet) close(){
@@ -87,7 +91,7 @@ func TestTable_pingpong(t *testing.T) {
 	tab := newTable(tn, selfId, addr,"./d0")
 	defer tab.Close()
 	w := &bondproc{done: make(chan struct{})}
-	tab.pingpong(w,true, targetId, target,0)
+	tab.pingpong(context.Background(), w,true, targetId, target,0, nil)
 	if w.err != nil {
 		t.Fatal(w.err)
 	}
@@ -119,7 +123,7 @@ func TestTable_bond(t *testing.T) {
 	}
 	tab := newTable(tn, selfId, addr,"./d0")
 	defer tab.Close()
-	n, err := tab.bond(true, targetId, target,9093)
+	n, err := tab.bond(context.Background(), true, targetId, target,9093, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -165,4 +169,148 @@ func TestA(t *testing.T) {
 		time.Sleep(1 * time.Second)
 	}
 	wg.Wait()
-}
\ No newline at end of file
+}
+// blockingNet answers pings but never replies to findnode.
+type blockingNet struct {
+	testNet
+}
+
+func (bn *blockingNet) findnode(ctx context.Context, toid NodeId, addr *net.UDPAddr, target NodeId) ([]*Node, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTable_lookupContext(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 9001}
+	tab := newTable(&blockingNet{}, NodeId{1}, addr, t.TempDir())
+	defer tab.Close()
+	tab.mu.Lock()
+	tab.add(tn.ns)
+	tab.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan []*Node)
+	go func() { done <- tab.LookupContext(ctx, NodeId{2}) }()
+	select {
+	case result := <-done:
+		if len(result) != len(tn.ns) {
+			t.Fatalf("got nodes: %d, want: %d", len(result), len(tn.ns))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lookup not stopped by the context")
+	}
+	// cancelled queries are not failures of the remote node
+	for _, n := range tn.ns {
+		if fails := tab.db.findFails(n.ID); fails != 0 {
+			t.Fatalf("got find failures of %s: %d, want: 0", n.ID, fails)
+		}
+	}
+}
+
+// slowPingNet answers pings once release is closed.
+type slowPingNet struct {
+	testNet
+	pinged  chan struct{}
+	release chan struct{}
+}
+
+func (sn *slowPingNet) ping(ctx context.Context, id NodeId, addr *net.UDPAddr) error {
+	sn.pinged <- struct{}{}
+	select {
+	case <-sn.release:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestTable_bondSharedContext(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 9001}
+	sn := &slowPingNet{pinged: make(chan struct{}, 1), release: make(chan struct{})}
+	tab := newTable(sn, NodeId{1}, addr, t.TempDir())
+	defer tab.Close()
+	id := NodeId{2}
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := tab.bond(ctx, true, id, addr, 9002, nil)
+		first <- err
+	}()
+	<-sn.pinged
+	second := make(chan error, 1)
+	go func() {
+		_, err := tab.bond(context.Background(), true, id, addr, 9002, nil)
+		second <- err
+	}()
+	// the first caller gives up, the shared bonding process goes on
+	cancel()
+	if err := <-first; err != context.Canceled {
+		t.Fatalf("got first err: %v, want: %v", err, context.Canceled)
+	}
+	close(sn.release)
+	select {
+	case err := <-second:
+		if err != nil {
+			t.Fatalf("got second err: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("second bond did not complete")
+	}
+}
+
+func TestTable_ban(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 9001}
+	tab := newTable(tn, NodeId{1}, addr, t.TempDir())
+	defer tab.Close()
+	tab.mu.Lock()
+	tab.add(tn.ns)
+	tab.mu.Unlock()
+	target := tn.ns[0]
+	if err := tab.Ban(Ban{ID: target.ID, Until: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	tab.mu.Lock()
+	size := tab.len()
+	tab.mu.Unlock()
+	if size != len(tn.ns)-1 {
+		t.Fatalf("got table size: %d, want: %d", size, len(tn.ns)-1)
+	}
+	if _, err := tab.bond(context.Background(), true, target.ID, target.addr(), target.TCP, nil); err != errBanned {
+		t.Fatalf("got bond err: %v, want: %v", err, errBanned)
+	}
+	if bans := tab.Bans(); len(bans) != 1 || bans[0].ID != target.ID {
+		t.Fatalf("got bans: %+v", bans)
+	}
+}
+
+// altNet answers verifying pings on the reachable addresses only.
+type altNet struct {
+	testNet
+	reachable []net.IP
+}
+
+func (an *altNet) verify(ctx context.Context, id NodeId, addr *net.UDPAddr) error {
+	for _, ip := range an.reachable {
+		if ip.Equal(addr.IP) {
+			return nil
+		}
+	}
+	return errTimeout
+}
+
+func TestTable_bondVerifiesAltIPs(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IP{10, 0, 0, 1}, Port: 9001}
+	reachable := net.IP{10, 0, 0, 3}
+	an := &altNet{reachable: []net.IP{reachable}}
+	tab := newTable(an, NodeId{1}, addr, t.TempDir())
+	defer tab.Close()
+	target := &net.UDPAddr{IP: net.IP{10, 0, 0, 2}, Port: 9002}
+	altIPs := []net.IP{{10, 0, 0, 9}, reachable}
+	n, err := tab.bond(context.Background(), true, NodeId{2}, target, 9003, altIPs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(n.AltIPs) != 1 || !n.AltIPs[0].Equal(reachable) {
+		t.Fatalf("got alt ips: %v, want: %v", n.AltIPs, []net.IP{reachable})
+	}
+}
@@ -1,18 +1,24 @@
 package discover
 
 import (
+	"context"
 	"github.com/xfs-network/xlibp2p/crypto"
 	"net"
 	"time"
 )
 
-var maxNeighbors int = 1024
+// maxNeighborsSize is the space for nodes in a single neighbors packet.
+const maxNeighborsSize = maxPacketSize - headSize - neighborsHeadSize
 
 
 type ping struct {
 	Version    int
 	From, To   rpcEndpoint
 	Expiration uint64
+	// AltIPs are further addresses of the sender, see Node.AltIPs.
+	AltIPs []net.IP
+	// hash is the hash of the received packet, it is echoed in the pong.
+	hash []byte
 }
 
 // pong is the reply to ping.
@@ -22,6 +28,9 @@ type pong struct {
 	// the external address (after NAT).
 	To rpcEndpoint
 	Expiration uint64 // Absolute timestamp at which the packet becomes invalid.
+	// ReplyTok is the hash of the answered ping packet, it proves that
+	// the ping reached the node. Pongs of older nodes do not carry it.
+	ReplyTok []byte
 }
 
 // findnode is a query for nodes close to the given target.
@@ -37,10 +46,11 @@ type neighbors struct {
 }
 
 type rpcNode struct {
-	IP  net.IP // len 4 for IPv4 or 16 for IPv6
-	UDP uint16 // for discovery protocol
-	TCP uint16 // for RLPx protocol
-	ID  NodeId
+	IP     net.IP // len 4 for IPv4 or 16 for IPv6
+	UDP    uint16 // for discovery protocol
+	TCP    uint16 // for RLPx protocol
+	ID     NodeId
+	AltIPs []net.IP
 }
 
 type rpcEndpoint struct {
@@ -61,14 +71,15 @@ func (req *ping) handle(t *udp, from *net.UDPAddr, fromID NodeId) error {
 	if req.Version != Version {
 		return errBadVersion
 	}
-	_ = t.send(from, pongPacket, pong{
+	_ = t.send(from, pongPacket, &pong{
 		To: makeEndpoint(from, req.From.TCP),
 		Expiration: uint64(time.Now().Add(expiration).Unix()),
+		ReplyTok: req.hash,
 	})
 	if !t.handleReply(fromID, pingPacket, req) {
 		// Note: we're ignoring the provided IP address right now
 		go func() {
-			_, _ = t.bond(true, fromID, from, req.From.TCP)
+			_, _ = t.bond(context.Background(), true, fromID, from, req.From.TCP, t.relayableIPs(from, validAltIPs(req.AltIPs)))
 		}()
 	}
 	return nil
@@ -103,15 +114,22 @@ func (req *findnode) handle(t *udp, from *net.UDPAddr, fromID NodeId) error {
 	closest := t.closest(target, bucketSize).entries
 	t.mu.Unlock()
 
-	p := neighbors{Expiration: uint64(time.Now().Add(expiration).Unix())}
-	// Send neighbors in chunks with at most maxNeighbors per packet
+	p := &neighbors{Expiration: uint64(time.Now().Add(expiration).Unix())}
+	// Send neighbors in chunks filling up each packet
 	// to stay below the 1280 byte limit.
-	for i, n := range closest {
-		p.Nodes = append(p.Nodes, nodeToRPC(n))
-		if len(p.Nodes) == maxNeighbors || i == len(closest)-1 {
+	size := 0
+	for _, n := range closest {
+		rn := nodeToRPC(n)
+		if size+rpcNodeSize(rn) > maxNeighborsSize {
 			_ = t.send(from, neighborsPacket, p)
 			p.Nodes = p.Nodes[:0]
+			size = 0
 		}
+		p.Nodes = append(p.Nodes, rn)
+		size += rpcNodeSize(rn)
+	}
+	if len(p.Nodes) > 0 {
+		_ = t.send(from, neighborsPacket, p)
 	}
 	return nil
 }
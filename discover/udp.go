@@ -3,13 +3,21 @@ package discover
 import (
 	"bytes"
 	"container/list"
+	"context"
 	"crypto/ecdsa"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/xfs-network/xlibp2p/common/ahash"
 	"github.com/xfs-network/xlibp2p/common/rawencode"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/metrics"
 	"github.com/xfs-network/xlibp2p/nat"
+	"github.com/xfs-network/xlibp2p/netutil"
 	"io"
+	"io/ioutil"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -24,6 +32,25 @@ var (
 	errTimeout          = errors.New("RPC timeout")
 	errClockWarp        = errors.New("reply deadline too far in the future")
 	errClosed           = errors.New("socket closed")
+	errPacketTooSmall   = errors.New("too small")
+	errPacketTooBig     = errors.New("packet too big")
+	errBadHash          = errors.New("bad hash")
+	errBadSignature     = errors.New("bad signature")
+	errBanned           = errors.New("node is banned")
+	errNotPermitted     = errors.New("address not permitted")
+	errRateLimited      = errors.New("rate limited")
+)
+
+const (
+	// macSize is the size of the hash at the start of every packet.
+	macSize = 32
+	// maxSigSize is the largest signature made by crypto.ECDSASign on P-256:
+	// total length and four length prefixed values of at most 32 bytes.
+	maxSigSize = 1 + 4*(1+32)
+	// headSize is the largest packet size without data.
+	headSize = macSize + maxSigSize + 1 + 2
+	// Discovery packets are defined to be no larger than 1280 bytes.
+	maxPacketSize = 1280
 )
 
 // Timeouts
@@ -43,24 +70,57 @@ const (
 )
 
 func makeEndpoint(addr *net.UDPAddr, tcpPort uint16) rpcEndpoint {
-	ip := addr.IP.To4()
-	if ip == nil {
-		ip = addr.IP.To16()
-	}
-	return rpcEndpoint{IP: ip, UDP: uint16(addr.Port), TCP: tcpPort}
+	return rpcEndpoint{IP: normIP(addr.IP), UDP: uint16(addr.Port), TCP: tcpPort}
 }
 
-func nodeFromRPC(rn rpcNode) (n *Node, valid bool) {
-	// TODO: don't accept localhost, LAN addresses from internet hosts
-	// TODO: check public key is on secp256k1 curve
+// nodeFromRPC converts a node relayed by sender. Nodes outside of the
+// permitted networks and LAN or loopback nodes relayed by hosts which
+// are not in such a network themselves are invalid.
+func (t *udp) nodeFromRPC(sender *net.UDPAddr, rn rpcNode) (n *Node, valid bool) {
 	if rn.IP.IsMulticast() || rn.IP.IsUnspecified() || rn.UDP == 0 {
 		return nil, false
 	}
-	return newNode(rn.IP,rn.TCP, rn.UDP, rn.ID ), true
+	if !t.relayable(sender, rn.IP) {
+		return nil, false
+	}
+	if _, err := rn.ID.PubKey(); err != nil {
+		return nil, false
+	}
+	n = newNode(rn.IP,rn.TCP, rn.UDP, rn.ID )
+	n.AltIPs = t.relayableIPs(sender, validAltIPs(rn.AltIPs))
+	return n, true
+}
+
+func (t *udp) relayable(sender *net.UDPAddr, ip net.IP) bool {
+	return netutil.CheckRelayIP(sender.IP, ip) == nil && t.netrestrict.Permits(ip)
+}
+
+// relayableIPs drops the IPs which are not relayable by sender, this
+// also applies to the addresses a node announces about itself.
+func (t *udp) relayableIPs(sender *net.UDPAddr, ips []net.IP) []net.IP {
+	var valid []net.IP
+	for _, ip := range ips {
+		if t.relayable(sender, ip) {
+			valid = append(valid, ip)
+		}
+	}
+	return valid
+}
+
+// validAltIPs drops the announced addresses which can not be dialed.
+func validAltIPs(ips []net.IP) []net.IP {
+	var valid []net.IP
+	for _, ip := range ips {
+		if ip.IsMulticast() || ip.IsUnspecified() {
+			continue
+		}
+		valid = append(valid, normIP(ip))
+	}
+	return valid
 }
 
 func nodeToRPC(n *Node) rpcNode {
-	return rpcNode{ID: n.ID, IP: n.IP, UDP: n.UDP, TCP: n.TCP}
+	return rpcNode{ID: n.ID, IP: n.IP, UDP: n.UDP, TCP: n.TCP, AltIPs: n.AltIPs}
 }
 
 type packet interface {
@@ -84,11 +144,41 @@ type udp struct {
 	addpending chan *pending
 	gotreply   chan reply
 
-	closing chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	metrics   metrics.Registry
+	// altIPs are announced in our pings next to the endpoint address.
+	altIPs []net.IP
+	// netrestrict limits the hosts we exchange packets with, nil permits all.
+	netrestrict *netutil.Restriction
+	// ingress and egress limit the packet traffic, nil does not limit.
+	ingress, egress *netutil.Limiter
 
 	*Table
 }
 
+// Config holds the optional settings of the discovery table.
+type Config struct {
+	// NodeDBPath is the directory of the node database, the database
+	// is kept in memory if it is empty.
+	NodeDBPath string
+	// Nat maps the UDP port and finds the external address if it is set.
+	Nat nat.Mapper
+	// AltIPs are further addresses on which the node is reachable with
+	// the same ports, e.g. the IPv6 address of a dual-stack host.
+	AltIPs []net.IP
+	// Metrics receives the packet rates and RPC timeouts if it is set.
+	Metrics metrics.Registry
+	// NetRestrict limits discovery to the permitted networks, packets of
+	// other hosts are dropped and their addresses are not relayed.
+	NetRestrict *netutil.Restriction
+	// Ingress and Egress limit the bandwidth of discovery, packets
+	// exceeding them are dropped. The traffic is not limited if nil.
+	Ingress *netutil.Limiter
+	Egress  *netutil.Limiter
+}
+
 // pending represents a pending reply.
 //
 // some implementations of the protocol wish to send more than one
@@ -127,7 +217,7 @@ type reply struct {
 }
 
 // ListenUDP returns a new table that listens for UDP packets on laddr.
-func ListenUDP(priv *ecdsa.PrivateKey, laddr string, nodeDBPath string, mapper nat.Mapper) (*Table, error) {
+func ListenUDP(priv *ecdsa.PrivateKey, laddr string, cfg Config) (*Table, error) {
 	addr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
 		return nil, err
@@ -136,82 +226,139 @@ func ListenUDP(priv *ecdsa.PrivateKey, laddr string, nodeDBPath string, mapper n
 	if err != nil {
 		return nil, err
 	}
-	tab, _ := newUDP(priv, conn, nodeDBPath, mapper)
+	tab, _ := newUDP(priv, conn, cfg)
 	return tab, nil
 }
-func NewUDP(priv *ecdsa.PrivateKey, c conn, nodeDBPath string, mapper nat.Mapper) (*Table, *udp) {
-	return newUDP(priv, c, nodeDBPath, mapper)
+
+// NewUDP returns a new table that serves discovery on c.
+func NewUDP(priv *ecdsa.PrivateKey, c conn, cfg Config) (*Table, *udp) {
+	return newUDP(priv, c, cfg)
 }
-func newUDP(priv *ecdsa.PrivateKey, c conn, nodeDBPath string, mapper nat.Mapper) (*Table, *udp) {
+func newUDP(priv *ecdsa.PrivateKey, c conn, cfg Config) (*Table, *udp) {
 	udp := &udp{
 		//logger: log.DefaultLogger(),
-		conn:       c,
-		priv:       priv,
-		closing:    make(chan struct{}),
-		gotreply:   make(chan reply),
-		addpending: make(chan *pending),
+		conn:        c,
+		priv:        priv,
+		closing:     make(chan struct{}),
+		gotreply:    make(chan reply),
+		addpending:  make(chan *pending),
+		metrics:     metrics.OrDiscard(cfg.Metrics),
+		altIPs:      validAltIPs(cfg.AltIPs),
+		netrestrict: cfg.NetRestrict,
+		ingress:     cfg.Ingress,
+		egress:      cfg.Egress,
 	}
+	mapper := cfg.Nat
 	realaddr := c.LocalAddr().(*net.UDPAddr)
 	if mapper != nil && !realaddr.IP.IsLoopback() {
-		go nat.Map(mapper, udp.closing, "udp", realaddr.Port, realaddr.Port, "xlibp2p discovery")
+		udp.wg.Add(1)
+		go func() {
+			defer udp.wg.Done()
+			nat.Map(mapper, udp.closing, "udp", realaddr.Port, realaddr.Port, "xlibp2p discovery")
+		}()
 	}else if mapper != nil {
 		if ext, err := mapper.ExternalIP(); err == nil {
 			realaddr = &net.UDPAddr{IP: ext, Port: realaddr.Port}
 		}
 	}
 	udp.ourEndpoint = makeEndpoint(realaddr, uint16(realaddr.Port))
-	udp.Table = newTable(udp, PubKey2NodeId(priv.PublicKey), realaddr, nodeDBPath)
+	udp.Table = newTable(udp, PubKey2NodeId(priv.PublicKey), realaddr, cfg.NodeDBPath)
+	udp.Table.self.AltIPs = udp.altIPs
+	udp.wg.Add(2)
 	go udp.loop()
 	go udp.readLoop()
 	return udp.Table, udp
 }
 
+// close shuts down the socket and waits for the loops to end,
+// it is safe to call it more than once.
 func (t *udp) close() {
-	close(t.closing)
-	_ = t.conn.Close()
-	// TODO: wait for the loops to end.
+	t.closeOnce.Do(func() {
+		close(t.closing)
+		_ = t.conn.Close()
+	})
+	t.wg.Wait()
 }
 
 // ping sends a ping message to the given node and waits for a reply.
-func (t *udp) ping(toid NodeId, toaddr *net.UDPAddr) error {
-	// TODO: maybe check for ReplyTo field in callback to measure RTT
-	errc := t.pending(toid, pongPacket, func(interface{}) bool { return true })
-	_ = t.send(toaddr, pingPacket, ping{
+func (t *udp) ping(ctx context.Context, toid NodeId, toaddr *net.UDPAddr) error {
+	return t.sendPing(ctx, toid, toaddr, false)
+}
+
+// verify pings the given address and only accepts the pong which echoes
+// the hash of the ping, so the node is known to be reachable there.
+func (t *udp) verify(ctx context.Context, toid NodeId, toaddr *net.UDPAddr) error {
+	return t.sendPing(ctx, toid, toaddr, true)
+}
+
+func (t *udp) sendPing(ctx context.Context, toid NodeId, toaddr *net.UDPAddr, verify bool) error {
+	if !t.netrestrict.Permits(toaddr.IP) {
+		return errNotPermitted
+	}
+	packet, err := encodePacket(t.priv, pingPacket, &ping{
 		Version:    Version,
 		From:       t.ourEndpoint,
 		To:         makeEndpoint(toaddr, 0), // TODO: maybe use known TCP port from DB
 		Expiration: uint64(time.Now().Add(expiration).Unix()),
+		AltIPs:     t.altIPs,
 	})
-	return <-errc
+	if err != nil {
+		return err
+	}
+	hash := packet[:macSize]
+	// TODO: maybe check for ReplyTo field in callback to measure RTT
+	errc := t.pending(toid, pongPacket, func(r interface{}) bool {
+		return !verify || bytes.Equal(r.(*pong).ReplyTok, hash)
+	})
+	_ = t.write(toaddr, pingPacket, packet)
+	return wait(ctx, errc)
 }
 
-func (t *udp) waitping(from NodeId) error {
-	return <-t.pending(from, pingPacket, func(interface{}) bool { return true })
+func (t *udp) waitping(ctx context.Context, from NodeId) error {
+	return wait(ctx, t.pending(from, pingPacket, func(interface{}) bool { return true }))
 }
 
 // findnode sends a findnode request to the given node and waits until
 // the node has sent up to k neighbors.
-func (t *udp) findnode(toid NodeId, toaddr *net.UDPAddr, target NodeId) ([]*Node, error) {
+func (t *udp) findnode(ctx context.Context, toid NodeId, toaddr *net.UDPAddr, target NodeId) ([]*Node, error) {
+	if !t.netrestrict.Permits(toaddr.IP) {
+		return nil, errNotPermitted
+	}
 	nodes := make([]*Node, 0, bucketSize)
 	nreceived := 0
 	errc := t.pending(toid, neighborsPacket, func(r interface{}) bool {
 		reply := r.(*neighbors)
 		for _, rn := range reply.Nodes {
 			nreceived++
-			if n, valid := nodeFromRPC(rn); valid {
+			if n, valid := t.nodeFromRPC(toaddr, rn); valid {
 				nodes = append(nodes, n)
 			}
 		}
 		return nreceived >= bucketSize
 	})
-	_ = t.send(toaddr, findnodePacket, findnode{
+	_ = t.send(toaddr, findnodePacket, &findnode{
 		Target: target,
 		Expiration: uint64(time.Now().Add(expiration).Unix()),
 	})
-	err := <-errc
+	err := wait(ctx, errc)
+	if ctx.Err() != nil {
+		// the callback may still be running
+		return nil, err
+	}
 	return nodes, err
 }
 
+// wait returns the result of a pending reply, or the error of ctx if it
+// is done first. The reply callback stays queued until its deadline.
+func wait(ctx context.Context, errc <-chan error) error {
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // pending adds a reply callback to the pending reply queue.
 // see the documentation of type pending for a detailed explanation.
 func (t *udp) pending(id NodeId, ptype byte, callback func(interface{}) bool) <-chan error {
@@ -247,6 +394,7 @@ func (t *udp) loop() {
 		refresh     = time.NewTicker(refreshInterval)
 	)
 	<-timeout.C // ignore first timeout
+	defer t.wg.Done()
 	defer refresh.Stop()
 	defer timeout.Stop()
 
@@ -279,7 +427,7 @@ func (t *udp) loop() {
 
 		select {
 		case <-refresh.C:
-			go t.refresh()
+			go t.refresh(context.Background())
 
 		case <-t.closing:
 			for el := plist.Front(); el != nil; el = el.Next() {
@@ -319,6 +467,7 @@ func (t *udp) loop() {
 				p := el.Value.(*pending)
 				//t.logger.Debugf("udp loop timeout tick, now: %s, p.deadline: %s", now, p.deadline)
 				if now.After(p.deadline) || now.Equal(p.deadline) {
+					t.metrics.Counter("discover_rpc_timeouts_total", "type", packetName(p.ptype)).Inc()
 					p.errc <- errTimeout
 					plist.Remove(el)
 				}
@@ -331,33 +480,71 @@ func (t *udp) send(toaddr *net.UDPAddr, ptype byte, req interface{}) error {
 	if err != nil {
 		return err
 	}
+	return t.write(toaddr, ptype, packet)
+}
+
+func (t *udp) write(toaddr *net.UDPAddr, ptype byte, packet []byte) error {
+	if !t.egress.Allow(len(packet)) {
+		t.metrics.Counter("discover_ratelimited_packets_total", "direction", "egress").Inc()
+		return errRateLimited
+	}
 	//t.logger.Infof(">>> %v %T\n", toaddr, req)
-	if _, err = t.conn.WriteToUDP(packet, toaddr); err != nil {
+	if _, err := t.conn.WriteToUDP(packet, toaddr); err != nil {
 		//t.logger.Errorln("UDP send failed:", err)
+		return err
 	}
-	return err
+	t.metrics.Counter("discover_egress_packets_total", "type", packetName(ptype)).Inc()
+	t.metrics.Counter("discover_egress_bytes_total").Add(uint64(len(packet)))
+	return nil
 }
 
+// packetName returns the name of a packet type used in metrics.
+func packetName(ptype byte) string {
+	switch ptype {
+	case pingPacket:
+		return "ping"
+	case pongPacket:
+		return "pong"
+	case findnodePacket:
+		return "findnode"
+	case neighborsPacket:
+		return "neighbors"
+	}
+	return "unknown"
+}
+
+// encodePacket signs and encodes a discovery packet.
+// packet = hash(32byte)+sign+type(1byte)+length(2byte)+data
+// sign covers type, length and data and carries its own length in
+// the first byte, hash covers everything after itself.
 func encodePacket(privateKey *ecdsa.PrivateKey, ptype byte, req interface{}) ([]byte, error) {
-	b := new(bytes.Buffer)
-	b.WriteByte(ptype)
-	nId := PubKey2NodeId(privateKey.PublicKey)
-	b.Write(nId[:])
 	bs,err := rawencode.Encode(req)
 	if err != nil {
 		return nil,err
 	}
-	bsLen := uint32(len(bs))
-	if (bsLen >> 8 ) > 0 {
-		return nil,fmt.Errorf("out")
+	if len(bs) > maxPacketSize-headSize {
+		return nil, errPacketTooBig
 	}
-	b.WriteByte(byte(uint32(len(bs))))
-	b.Write(bs)
-	return b.Bytes(), nil
+	body := make([]byte, 3, 3+len(bs))
+	body[0] = ptype
+	binary.LittleEndian.PutUint16(body[1:], uint16(len(bs)))
+	body = append(body, bs...)
+	sig, err := crypto.ECDSASign(ahash.SHA256(body), privateKey)
+	if err != nil {
+		return nil, err
+	}
+	b := new(bytes.Buffer)
+	b.Write(make([]byte, macSize))
+	b.Write(sig)
+	b.Write(body)
+	packet := b.Bytes()
+	copy(packet, ahash.SHA256(packet[macSize:]))
+	return packet, nil
 }
 
 // readLoop runs in its own goroutine. it handles incoming UDP packets.
 func (t *udp) readLoop() {
+	defer t.wg.Done()
 	defer func() {
 		if err := t.conn.Close(); err != nil {
 			//t.logger.Errorln(err)
@@ -366,12 +553,16 @@ func (t *udp) readLoop() {
 	// Discovery packets are defined to be no larger than 1280 bytes.
 	// Packets larger than this size will be cut at the end and treated
 	// as invalid because their hash won't match.
-	buf := make([]byte, 1280)
+	buf := make([]byte, maxPacketSize)
 	for {
 		nbytes, from, err := t.conn.ReadFromUDP(buf)
 		if err != nil {
 			return
 		}
+		if !t.ingress.Allow(nbytes) {
+			t.metrics.Counter("discover_ratelimited_packets_total", "direction", "ingress").Inc()
+			continue
+		}
 		err = t.handlePacket(from, buf[:nbytes])
 		if err != nil {
 			continue
@@ -381,11 +572,18 @@ func (t *udp) readLoop() {
 
 func (t *udp) handlePacket(from *net.UDPAddr, buf []byte) error {
 	buffer :=  bytes.NewBuffer(buf)
+	t.metrics.Counter("discover_ingress_bytes_total").Add(uint64(len(buf)))
+	if !t.netrestrict.Permits(from.IP) {
+		t.metrics.Counter("discover_restricted_packets_total").Inc()
+		return errNotPermitted
+	}
 	packet, fromID, err := decodePacket(buffer)
 	if err != nil {
 		//t.logger.Debugf("Bad packet from %v: %v", from, err)
+		t.metrics.Counter("discover_invalid_packets_total").Inc()
 		return err
 	}
+	t.metrics.Counter("discover_ingress_packets_total", "type", packetName(packetType(packet))).Inc()
 	//status := "ok"
 	if err = packet.handle(t, from, fromID); err != nil {
 		//status = err.Error()
@@ -396,54 +594,60 @@ func (t *udp) handlePacket(from *net.UDPAddr, buf []byte) error {
 }
 
 
-type packetHead struct {
-	mType uint8
-	id NodeId
-	dataLen uint8
+// packetType returns the type of a decoded packet.
+func packetType(p packet) byte {
+	switch p.(type) {
+	case *ping:
+		return pingPacket
+	case *pong:
+		return pongPacket
+	case *findnode:
+		return findnodePacket
+	case *neighbors:
+		return neighborsPacket
+	}
+	return 0
 }
 
-func decodePacketHead(reader io.Reader) (*packetHead,int,error) {
-	headerBuf := bytes.NewBuffer(nil)
-	var offset int
-	for headerBuf.Len() < nodeIdLen + 2 {
-		b := make([]byte, 1)
-		if n, err := reader.Read(b); err != nil {
-			offset += n
-			return nil, offset, err
-		}else {
-			offset += n
-		}
-		headerBuf.Write(b)
-	}
-	var err error = nil
-	h := new(packetHead)
-	h.mType, err = headerBuf.ReadByte()
-	if err != nil {
-		return nil,offset, err
-	}
-	nid := NodeId{}
-	_, err = headerBuf.Read(nid[:])
-	if err != nil {
-		return nil,offset, err
-	}
-	h.id = nid
-	h.dataLen, err = headerBuf.ReadByte()
-	return h, offset, err
+// IsPacket reports whether buf carries the hash of a discovery packet,
+// transports sharing the UDP socket of the discovery use it to tell the
+// packets apart.
+func IsPacket(buf []byte) bool {
+	return len(buf) > macSize && bytes.Equal(buf[:macSize], ahash.SHA256(buf[macSize:]))
 }
+
+// decodePacket verifies the hash and signature of a discovery packet
+// and returns it together with the node id of the signer.
 func decodePacket(reader io.Reader) (packet, NodeId, error) {
-	h, _, err := decodePacketHead(reader)
+	buf, err := ioutil.ReadAll(reader)
 	if err != nil {
-		return nil,NodeId{},err
+		return nil, NodeId{}, err
 	}
-	var data = make([]byte, h.dataLen)
-	_, err = reader.Read(data)
+	if len(buf) < macSize+1 {
+		return nil, NodeId{}, errPacketTooSmall
+	}
+	hash, sigdata := buf[:macSize], buf[macSize:]
+	if !bytes.Equal(hash, ahash.SHA256(sigdata)) {
+		return nil, NodeId{}, errBadHash
+	}
+	sigLen := int(sigdata[0]) + 1
+	if len(sigdata) < sigLen+3 {
+		return nil, NodeId{}, errPacketTooSmall
+	}
+	sig, body := sigdata[:sigLen], sigdata[sigLen:]
+	fromID, err := recoverNodeID(ahash.SHA256(body), sig)
 	if err != nil {
-		return nil,NodeId{}, err
+		return nil, NodeId{}, err
+	}
+	ptype, dataLen := body[0], int(binary.LittleEndian.Uint16(body[1:]))
+	if len(body) < 3+dataLen {
+		return nil, fromID, errPacketTooSmall
 	}
+	data := body[3 : 3+dataLen]
 	var req packet
-	switch ptype := h.mType; ptype {
+	switch ptype {
 	case pingPacket:
-		req = new(ping)
+		req = &ping{hash: append([]byte{}, hash...)}
 	case pongPacket:
 		req = new(pong)
 	case findnodePacket:
@@ -451,8 +655,8 @@ func decodePacket(reader io.Reader) (packet, NodeId, error) {
 	case neighborsPacket:
 		req = new(neighbors)
 	default:
-		return nil, h.id, fmt.Errorf("unknown type: %d", ptype)
+		return nil, fromID, fmt.Errorf("unknown type: %d", ptype)
 	}
 	err = rawencode.Decode(data, req)
-	return req, h.id, err
+	return req, fromID, err
 }
@@ -2,7 +2,11 @@ package discover
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"github.com/xfs-network/xlibp2p/common/ahash"
 	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/netutil"
 	"net"
 	"testing"
 	"time"
@@ -35,22 +39,30 @@ func Test_encodePacket(t *testing.T) {
 		To: makeEndpoint(targetAddr, 0),
 		Expiration: uint64(time.Now().Add(expiration).Unix()),
 	}
-	raw, err := encodePacket(key, pingPacket, pingPacketObj)
+	raw, err := encodePacket(key, pingPacket, &pingPacketObj)
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Logf("encode raw: %x", raw)
-	gotType := raw[0]
+	if !bytes.Equal(raw[:macSize], ahash.SHA256(raw[macSize:])) {
+		t.Fatalf("got packet hash: %x, want: %x", raw[:macSize], ahash.SHA256(raw[macSize:]))
+	}
+	sigLen := int(raw[macSize]) + 1
+	body := raw[macSize+sigLen:]
+	gotType := body[0]
 	if gotType != pingPacket{
 		t.Fatalf("got packet type: %d, want: %x", gotType, pingPacket)
 	}
 	wantId := PubKey2NodeId(key.PublicKey)
-	gotId := raw[1:nodeIdLen+1]
-	t.Logf("nodeId raw: %x", gotId)
-	if !bytes.Equal(wantId[:], gotId) {
+	gotId, err := recoverNodeID(ahash.SHA256(body), raw[macSize:macSize+sigLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("nodeId raw: %x", gotId[:])
+	if !bytes.Equal(wantId[:], gotId[:]) {
 		t.Fatalf("got node id: %x, want: %x", gotId, wantId[:])
 	}
-	data := raw[1 + len(gotId):]
+	data := body[3:]
 	t.Logf("data raw: %x", data)
 	t.Logf("data string: %s", string(data))
 }
@@ -86,7 +98,7 @@ func Test_decodePacket(t *testing.T) {
 		To: makeEndpoint(targetAddr, 0),
 		Expiration: uint64(time.Now().Add(expiration).Unix()),
 	}
-	raw, err := encodePacket(key, pingPacket, pingPacketObj)
+	raw, err := encodePacket(key, pingPacket, &pingPacketObj)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -112,4 +124,134 @@ func Test_decodePacket(t *testing.T) {
 	}
 	assertRpcEndpoint(t,"from", &gotPack.From, &pingPacketObj.From)
 	assertRpcEndpoint(t,"to", &gotPack.To, &pingPacketObj.To)
-}
\ No newline at end of file
+}
+
+func Test_decodePacketForged(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := encodePacket(key, findnodePacket, &findnode{
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tamper with the payload and fix up the hash, the signature must fail
+	forged := append([]byte{}, raw...)
+	forged[len(forged)-2] ^= 0xff
+	copy(forged, ahash.SHA256(forged[macSize:]))
+	if _, _, err = decodePacket(bytes.NewReader(forged)); err != errBadSignature {
+		t.Fatalf("got err: %v, want: %v", err, errBadSignature)
+	}
+	// tamper without fixing the hash
+	forged = append([]byte{}, raw...)
+	forged[len(forged)-2] ^= 0xff
+	if _, _, err = decodePacket(bytes.NewReader(forged)); err != errBadHash {
+		t.Fatalf("got err: %v, want: %v", err, errBadHash)
+	}
+	if _, _, err = decodePacket(bytes.NewReader(raw[:macSize])); err != errPacketTooSmall {
+		t.Fatalf("got err: %v, want: %v", err, errPacketTooSmall)
+	}
+}
+
+func Test_nodeFromRPC(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := PubKey2NodeId(key.PublicKey)
+	restrict := new(netutil.Restriction)
+	restrict.Deny.MustAdd("1.2.3.0/24")
+	u := &udp{netrestrict: restrict}
+	wan := &net.UDPAddr{IP: net.IP{8, 8, 8, 8}, Port: 9001}
+	lan := &net.UDPAddr{IP: net.IP{192, 168, 0, 2}, Port: 9001}
+	tests := []struct {
+		sender *net.UDPAddr
+		ip     net.IP
+		valid  bool
+	}{
+		{wan, net.IP{5, 6, 7, 8}, true},
+		{wan, net.IP{192, 168, 0, 1}, false},
+		{lan, net.IP{192, 168, 0, 1}, true},
+		{wan, net.IP{127, 0, 0, 1}, false},
+		{wan, net.IP{1, 2, 3, 4}, false},
+	}
+	for _, test := range tests {
+		rn := rpcNode{IP: test.ip, UDP: 9001, TCP: 9001, ID: id}
+		if _, valid := u.nodeFromRPC(test.sender, rn); valid != test.valid {
+			t.Fatalf("node %s from %s got valid: %v, want: %v", test.ip, test.sender, valid, test.valid)
+		}
+	}
+	// alternative addresses are filtered the same way
+	rn := rpcNode{IP: net.IP{5, 6, 7, 8}, UDP: 9001, TCP: 9001, ID: id,
+		AltIPs: []net.IP{{10, 0, 0, 1}, {1, 2, 3, 5}, net.ParseIP("2a00::1")}}
+	n, valid := u.nodeFromRPC(wan, rn)
+	if !valid || len(n.AltIPs) != 1 || !n.AltIPs[0].Equal(net.ParseIP("2a00::1")) {
+		t.Fatalf("got node: %+v, valid: %v", n, valid)
+	}
+	// and so are the addresses a WAN host announces about itself
+	ips := u.relayableIPs(wan, []net.IP{{127, 0, 0, 1}, {192, 168, 0, 1}, {5, 6, 7, 9}})
+	if len(ips) != 1 || !ips[0].Equal(net.IP{5, 6, 7, 9}) {
+		t.Fatalf("got announced ips: %v", ips)
+	}
+}
+
+func newTestUDP(t *testing.T) (*udp, *ecdsa.PrivateKey) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tab, u := newUDP(key, conn, Config{NodeDBPath: t.TempDir()})
+	t.Cleanup(tab.Close)
+	return u, key
+}
+
+func TestUDP_verify(t *testing.T) {
+	a, _ := newTestUDP(t)
+	b, bkey := newTestUDP(t)
+	bid, baddr := PubKey2NodeId(bkey.PublicKey), b.conn.LocalAddr().(*net.UDPAddr)
+	if err := a.verify(context.Background(), bid, baddr); err != nil {
+		t.Fatalf("verify reachable address err: %v", err)
+	}
+	// a pong which does not echo the ping does not verify an address
+	// on which the node is not reachable
+	dead := &net.UDPAddr{IP: net.IP{127, 0, 0, 1}, Port: 1}
+	errc := make(chan error, 1)
+	go func() { errc <- a.verify(context.Background(), bid, dead) }()
+	time.Sleep(50 * time.Millisecond)
+	packet, err := encodePacket(bkey, pongPacket, &pong{
+		To:         makeEndpoint(dead, 0),
+		Expiration: uint64(time.Now().Add(expiration).Unix()),
+		ReplyTok:   make([]byte, macSize),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = a.handlePacket(baddr, packet)
+	if err := <-errc; err != errTimeout {
+		t.Fatalf("got verify err: %v, want: %v", err, errTimeout)
+	}
+}
+
+func TestIsPacket(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet, err := encodePacket(key, findnodePacket, &findnode{Expiration: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsPacket(packet) {
+		t.Fatal("discovery packet not recognized")
+	}
+	packet[len(packet)-1]++
+	if IsPacket(packet) || IsPacket(packet[:macSize]) {
+		t.Fatal("foreign packet recognized")
+	}
+}
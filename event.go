@@ -0,0 +1,89 @@
+package p2p
+
+import (
+	"github.com/xfs-network/xlibp2p/discover"
+	"sync"
+)
+
+// PeerEventType is the type of events emitted by a server.
+type PeerEventType string
+
+const (
+	// PeerEventTypeAdd is emitted when a peer is added to the server.
+	PeerEventTypeAdd PeerEventType = "add"
+	// PeerEventTypeDrop is emitted when a peer is dropped from the server.
+	PeerEventTypeDrop PeerEventType = "drop"
+	// PeerEventTypeHandshakeFailed is emitted when a connection fails the handshake.
+	PeerEventTypeHandshakeFailed PeerEventType = "handshakefailed"
+	// PeerEventTypeMsgSend is emitted when a protocol message is sent to a peer.
+	PeerEventTypeMsgSend PeerEventType = "msgsend"
+	// PeerEventTypeMsgRecv is emitted when a protocol message is received from a peer.
+	PeerEventTypeMsgRecv PeerEventType = "msgrecv"
+	// PeerEventTypeNodeAdded is emitted when a node is added to the discovery table.
+	PeerEventTypeNodeAdded PeerEventType = "nodeadded"
+	// PeerEventTypeNodeRemoved is emitted when a node is removed from the discovery table.
+	PeerEventTypeNodeRemoved PeerEventType = "noderemoved"
+	// PeerEventTypeBanned is emitted when a peer is banned because of its score.
+	PeerEventTypeBanned PeerEventType = "banned"
+)
+
+// PeerEvent is an event emitted when peers are added or dropped, when
+// messages are exchanged, or when the discovery table changes.
+type PeerEvent struct {
+	Type       PeerEventType   `json:"type"`
+	Peer       discover.NodeId `json:"peer"`
+	RemoteAddr string          `json:"remote_addr,omitempty"`
+	Reason     string          `json:"reason,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Protocol   string          `json:"protocol,omitempty"`
+	MsgCode    uint8           `json:"msg_code,omitempty"`
+	MsgSize    uint32          `json:"msg_size,omitempty"`
+}
+
+// Subscription is returned by Server.SubscribeEvents.
+type Subscription interface {
+	// Unsubscribe stops the delivery of events, it is safe
+	// to call it more than once.
+	Unsubscribe()
+}
+
+// eventFeed delivers events to all subscribed channels. Sends never
+// block, events are dropped for subscribers whose channel is full.
+// The zero value is ready to use.
+type eventFeed struct {
+	mu   sync.Mutex
+	subs map[*eventSub]struct{}
+}
+
+type eventSub struct {
+	feed *eventFeed
+	ch   chan<- *PeerEvent
+}
+
+func (f *eventFeed) subscribe(ch chan<- *PeerEvent) Subscription {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs == nil {
+		f.subs = make(map[*eventSub]struct{})
+	}
+	sub := &eventSub{feed: f, ch: ch}
+	f.subs[sub] = struct{}{}
+	return sub
+}
+
+func (f *eventFeed) send(ev *PeerEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for sub := range f.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+		}
+	}
+}
+
+func (s *eventSub) Unsubscribe() {
+	s.feed.mu.Lock()
+	defer s.feed.mu.Unlock()
+	delete(s.feed.subs, s)
+}
@@ -24,7 +24,19 @@ type chatProtocol struct {
 	server p2p.Server
 }
 
-func (cp *chatProtocol) Run(p p2p.Peer) error {
+func (cp *chatProtocol) Name() string {
+	return "chat"
+}
+
+func (cp *chatProtocol) Version() uint {
+	return 1
+}
+
+func (cp *chatProtocol) Length() uint8 {
+	return 1
+}
+
+func (cp *chatProtocol) Run(p p2p.ProtocolPeer) error {
 	if cp.ps == nil {
 		cp.ps = make(map[discover.NodeId]p2p.Peer)
 	}
@@ -45,13 +57,13 @@ func (cp *chatProtocol) Run(p p2p.Peer) error {
 }
 
 
-func (cp *chatProtocol) handleMsg(p p2p.Peer) error {
+func (cp *chatProtocol) handleMsg(p p2p.ProtocolPeer) error {
 	ch := p.GetProtocolMsgCh()
 	select {
 	case <- p.CloseCh():
 		return nil
 	case mr := <-ch:
-		if mr.Type() == 4 {
+		if mr.Type() == 0 {
 			bs,_ := mr.ReadAll()
 			nId := p.ID()
 			fmt.Printf("<(%x...%x): %s\n",nId[:3],nId[len(nId)-3:], string(bs))
@@ -62,7 +74,7 @@ func (cp *chatProtocol) handleMsg(p p2p.Peer) error {
 
 func (cp *chatProtocol) sendMessage(txt string) {
 	for _, p := range cp.ps {
-		err := p.WriteMessage(4, []byte(txt))
+		err := p.WriteMessage(0, []byte(txt))
 		if err != nil {
 			continue
 		}
@@ -206,7 +218,9 @@ func main() {
 	cp := &chatProtocol{
 		server: srv,
 	}
-	srv.Bind(cp)
+	if err := srv.Bind(cp); err != nil {
+		panic(err)
+	}
 	if err := srv.Start(); err != nil {
 		panic(err)
 	}
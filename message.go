@@ -3,11 +3,25 @@ package p2p
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/xfs-network/xlibp2p/common/ahash"
 	"github.com/xfs-network/xlibp2p/discover"
 	"io"
 )
 
 const headerLen = 6
+
+const (
+	// baseMaxMsgSize limits the messages of the base protocol, the largest
+	// is a protocol handshake announcing 255 protocols with long names.
+	baseMaxMsgSize = 1 << 17
+	// defaultMaxMsgSize limits the messages of protocols which do not set
+	// their own limit, unless Config.MaxMessageSize is set.
+	defaultMaxMsgSize = 16 << 20
+)
+
+var errMsgTooLarge = errors.New("message too large")
 //MessageReader interface defines type of message and reading methods,
 //messageReader implements this interface.
 type MessageReader interface {
@@ -24,6 +38,12 @@ type messageReader struct {
 	mType   uint8
 	raw     io.Reader
 	data    io.Reader
+	// payload is the data of the message if it is held in memory,
+	// data then reads from it.
+	payload []byte
+	// wireSize is the size of the message as received, before it was
+	// decompressed.
+	wireSize int
 }
 
 // Type returns message type
@@ -36,8 +56,13 @@ func (m *messageReader) Read(p []byte) (int, error) {
 	return m.data.Read(p)
 }
 
-// ReadAll reads all of data in the message
+// ReadAll reads all of data in the message, the data is returned
+// without copying if nothing has been read yet.
 func (m *messageReader) ReadAll() ([]byte, error) {
+	if r, ok := m.data.(*bytes.Reader); ok && m.payload != nil && r.Len() == len(m.payload) {
+		_, _ = r.Seek(0, io.SeekEnd)
+		return m.payload, nil
+	}
 	return io.ReadAll(m.data)
 }
 
@@ -53,102 +78,202 @@ func (m *messageReader) DataReader() io.Reader {
 
 // ReadMessage reads message from other peer and returns MessageReader by header of message.
 // message = version(1byte)+type(1byte)+length(4byte)+data
+// Messages larger than defaultMaxMsgSize are rejected.
 func ReadMessage(reader io.Reader) (MessageReader, error) {
-	mBuffer := bytes.NewBuffer(nil)
+	return readMessage(reader, func(uint8) uint32 {
+		return defaultMaxMsgSize
+	})
+}
 
-	//vertion and type
-	for mBuffer.Len() < 6 {
-		b := make([]byte, 1)
-		if _, err := reader.Read(b); err != nil {
-			return nil, err
-		}
-		mBuffer.Write(b)
+// readMessage reads a message whose data must not exceed the limit of its
+// type. The length is checked before anything is allocated and the data is
+// read into a single buffer of its exact size.
+func readMessage(reader io.Reader, limit func(mType uint8) uint32) (*messageReader, error) {
+	header := make([]byte, headerLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
 	}
-	header := mBuffer.Bytes()
+	mType := header[1]
 	//length of data in message.4 bytes stored by LittleEndian model.
 	n := binary.LittleEndian.Uint32(header[2:])
-
-	for mBuffer.Len() < 6+int(n) {
-		b := make([]byte, 1)
-
-		if _, err := reader.Read(b); err != nil {
-			return nil, err
-		}
-
-		mBuffer.Write(b)
+	if max := limit(mType); n > max {
+		return nil, fmt.Errorf("%w: type %d, size %d, limit %d", errMsgTooLarge, mType, n, max)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
 	}
-
-	data := mBuffer.Bytes()
-
 	return &messageReader{
-		raw:   mBuffer,
-		mType: data[1],
-		data:  bytes.NewReader(data[6:]),
+		version:  header[0],
+		raw:      io.MultiReader(bytes.NewReader(header), bytes.NewReader(payload)),
+		mType:    mType,
+		data:     bytes.NewReader(payload),
+		payload:  payload,
+		wireSize: headerLen + len(payload),
 	}, nil
 }
 
-type helloRequestMsg struct {
-	raw       []byte
-	version   uint8
-	id        discover.NodeId
-	receiveId discover.NodeId
+const (
+	helloNonceLen = 32
+	helloFixedLen = 3*len(discover.NodeId{}) + helloNonceLen
+)
+
+// helloMsg is the signed message exchanged by both sides of the handshake.
+// data = id(64byte)+receiveId(64byte)+ephemeralKey(64byte)+nonce(32byte)+sign.
+// ephemeralKey is the public part of a key generated for this session only and is
+// encoded like a node id. sign is made with the key behind id and covers every
+// other field, the reply also covers the nonce of the request it answers.
+type helloMsg struct {
+	raw          []byte
+	version      uint8
+	id           discover.NodeId
+	receiveId    discover.NodeId
+	ephemeralKey discover.NodeId
+	nonce        [helloNonceLen]byte
+	sign         []byte
+}
+
+func (m *helloMsg) body() []byte {
+	body := make([]byte, 0, helloFixedLen+len(m.sign))
+	body = append(body, m.id[:]...)
+	body = append(body, m.receiveId[:]...)
+	body = append(body, m.ephemeralKey[:]...)
+	body = append(body, m.nonce[:]...)
+	return body
 }
 
-func (m *helloRequestMsg) marshal() []byte {
+// sigHash returns the hash signed by the sender of the message.
+func (m *helloMsg) sigHash(mType uint8, remoteNonce []byte) []byte {
+	buf := append([]byte{m.version, mType}, m.body()...)
+	buf = append(buf, remoteNonce...)
+	return ahash.SHA256(buf)
+}
+
+func (m *helloMsg) marshal(mType uint8) []byte {
 	if m.raw != nil {
 		return m.raw
 	}
-	cLen := len(m.id) + len(m.receiveId)
-	val := make([]byte, cLen+4)
-	binary.LittleEndian.PutUint32(val, uint32(cLen))
-	copy(val[4:], append(m.id[:], m.receiveId[:]...))
-	base := []byte{m.version, typeHelloRequest}
+	body := append(m.body(), m.sign...)
+	val := make([]byte, len(body)+4)
+	binary.LittleEndian.PutUint32(val, uint32(len(body)))
+	copy(val[4:], body)
+	base := []byte{m.version, mType}
 	base = append(base, val...)
 	return base
 }
 
-func (m *helloRequestMsg) unmarshal(data []byte) bool {
-	m.raw = data
-	m.version = data[0]
-	if data[1] != typeHelloRequest {
+func (m *helloMsg) unmarshal(mType uint8, data []byte) bool {
+	if len(data) < headerLen || data[1] != mType {
 		return false
 	}
 	cLen := binary.LittleEndian.Uint32(data[2:headerLen])
-	body := data[headerLen: headerLen + cLen]
-	copy(m.id[:], body[:len(m.id)])
-	copy(m.receiveId[:], body[len(m.id):])
+	if cLen < uint32(helloFixedLen) || uint32(len(data)-headerLen) < cLen {
+		return false
+	}
+	m.raw = data
+	m.version = data[0]
+	body := data[headerLen : headerLen+cLen]
+	offset := copy(m.id[:], body)
+	offset += copy(m.receiveId[:], body[offset:])
+	offset += copy(m.ephemeralKey[:], body[offset:])
+	offset += copy(m.nonce[:], body[offset:])
+	m.sign = body[offset:]
 	return true
 }
 
-type helloReRequestMsg struct {
-	raw       []byte
-	version   uint8
-	id        discover.NodeId
-	receiveId discover.NodeId
+type helloRequestMsg helloMsg
+
+func (m *helloRequestMsg) sigHash() []byte {
+	return (*helloMsg)(m).sigHash(typeHelloRequest, nil)
+}
+
+func (m *helloRequestMsg) marshal() []byte {
+	return (*helloMsg)(m).marshal(typeHelloRequest)
+}
+
+func (m *helloRequestMsg) unmarshal(data []byte) bool {
+	return (*helloMsg)(m).unmarshal(typeHelloRequest, data)
+}
+
+type helloReRequestMsg helloMsg
+
+// sigHash returns the hash signed by the responder, which is bound
+// to the nonce of the request.
+func (m *helloReRequestMsg) sigHash(reqNonce []byte) []byte {
+	return (*helloMsg)(m).sigHash(typeReHelloRequest, reqNonce)
 }
 
 func (m *helloReRequestMsg) marshal() []byte {
-	if m.raw != nil {
-		return m.raw
-	}
-	cLen := len(m.id) + len(m.receiveId)
-	val := make([]byte, cLen+4)
-	binary.LittleEndian.PutUint32(val, uint32(cLen))
-	copy(val[4:], append(m.id[:], m.receiveId[:]...))
-	base := []byte{m.version, typeReHelloRequest}
-	base = append(base, val...)
-	return base
+	return (*helloMsg)(m).marshal(typeReHelloRequest)
 }
 
 func (m *helloReRequestMsg) unmarshal(data []byte) bool {
-	m.raw = data
-	m.version = data[0]
-	if data[1] != typeReHelloRequest {
+	return (*helloMsg)(m).unmarshal(typeReHelloRequest, data)
+}
+
+// maxCodecNameLen is the longest codec name, see protoHandshakeMsg.
+const maxCodecNameLen = 255
+
+// protoHandshakeMsg announces the protocols supported by the sender,
+// it is the first message sent over the encrypted channel.
+// data = count(1byte)+[nameLen(1byte)+name+version(4byte)]...+[codecs]
+// codecs = count(1byte)+[nameLen(1byte)+name]...
+// The codecs section lists the compression codecs of the sender in order
+// of preference, it is left out if there are none.
+type protoHandshakeMsg struct {
+	caps   []Cap
+	codecs []string
+}
+
+func (m *protoHandshakeMsg) marshal() []byte {
+	buf := []byte{uint8(len(m.caps))}
+	for _, c := range m.caps {
+		var version [4]byte
+		binary.LittleEndian.PutUint32(version[:], uint32(c.Version))
+		buf = append(buf, uint8(len(c.Name)))
+		buf = append(buf, c.Name...)
+		buf = append(buf, version[:]...)
+	}
+	if len(m.codecs) > 0 {
+		buf = append(buf, uint8(len(m.codecs)))
+		for _, name := range m.codecs {
+			buf = append(buf, uint8(len(name)))
+			buf = append(buf, name...)
+		}
+	}
+	return buf
+}
+
+func (m *protoHandshakeMsg) unmarshal(data []byte) bool {
+	if len(data) < 1 {
 		return false
 	}
-	cLen := binary.LittleEndian.Uint32(data[2:headerLen])
-	body := data[headerLen: headerLen + cLen]
-	copy(m.id[:], body[:len(m.id)])
-	copy(m.receiveId[:], body[len(m.id):])
+	count := int(data[0])
+	data = data[1:]
+	m.caps = make([]Cap, 0, count)
+	for i := 0; i < count; i++ {
+		if len(data) < 1 || len(data) < 1+int(data[0])+4 {
+			return false
+		}
+		nameLen := int(data[0])
+		name := string(data[1 : 1+nameLen])
+		version := binary.LittleEndian.Uint32(data[1+nameLen:])
+		m.caps = append(m.caps, Cap{Name: name, Version: uint(version)})
+		data = data[1+nameLen+4:]
+	}
+	m.codecs = nil
+	if len(data) == 0 {
+		return true
+	}
+	count = int(data[0])
+	data = data[1:]
+	for i := 0; i < count; i++ {
+		if len(data) < 1 || len(data) < 1+int(data[0]) {
+			return false
+		}
+		nameLen := int(data[0])
+		m.codecs = append(m.codecs, string(data[1:1+nameLen]))
+		data = data[1+nameLen:]
+	}
 	return true
 }
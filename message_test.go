@@ -1,8 +1,11 @@
 package p2p
 
 import (
+	"bytes"
 	"github.com/xfs-network/xlibp2p/crypto"
 	"github.com/xfs-network/xlibp2p/discover"
+	"io"
+	"io/ioutil"
 	"testing"
 )
 
@@ -32,3 +35,28 @@ func TestHello2(t *testing.T) {
 	n := uint32(data[2]) | uint32(data[3])<<8 | uint32(data[4])<<16 | uint32(data[5])<<24
 	t.Logf("n: %v\n", n)
 }
+
+func TestReadMessage(t *testing.T) {
+	raw := []byte{version2, typePingMsg, 5, 0, 0, 0, 'h', 'e', 'l', 'l', 'o'}
+	msg, err := ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := msg.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != typePingMsg || string(data) != "hello" {
+		t.Fatalf("got type: %d, data: %s", msg.Type(), data)
+	}
+	gotRaw, err := ioutil.ReadAll(msg.RawReader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(gotRaw, raw) {
+		t.Fatalf("got raw: %x, want: %x", gotRaw, raw)
+	}
+	if _, err = ReadMessage(bytes.NewReader(raw[:len(raw)-1])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("got err: %v, want: %v", err, io.ErrUnexpectedEOF)
+	}
+}
@@ -0,0 +1,23 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+)
+
+// Exporter is implemented by registries which can write their metrics
+// in the Prometheus text format.
+type Exporter interface {
+	WritePrometheus(w io.Writer) error
+}
+
+// Handler returns an http.Handler which serves the metrics of e in the
+// Prometheus text format.
+func Handler(e Exporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := e.WritePrometheus(w); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
@@ -0,0 +1,65 @@
+// Package metrics provides the counters, gauges and histograms used to
+// instrument the p2p server and node discovery.
+//
+// Metrics are obtained from a Registry by name and optional label pairs,
+// asking twice for the same name and labels returns the same metric.
+// The StandardRegistry keeps the metrics in memory and writes them in the
+// Prometheus text exposition format, other registries can be plugged in
+// by implementing Registry.
+package metrics
+
+// Counter is a value which only increases.
+type Counter interface {
+	Inc()
+	Add(delta uint64)
+}
+
+// Gauge is a value which may increase and decrease.
+type Gauge interface {
+	Set(v int64)
+	Inc()
+	Dec()
+}
+
+// Histogram samples observations into buckets.
+type Histogram interface {
+	Observe(v float64)
+}
+
+// Registry creates and looks up metrics. Labels are given as key value
+// pairs, e.g. r.Counter("requests_total", "method", "get").
+type Registry interface {
+	Counter(name string, labels ...string) Counter
+	Gauge(name string, labels ...string) Gauge
+	// Histogram returns the histogram with the given upper bounds of its
+	// buckets, the buckets of an existing histogram are not changed.
+	Histogram(name string, buckets []float64, labels ...string) Histogram
+}
+
+// DefBuckets are the default histogram buckets for durations in seconds.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Discard is a registry whose metrics do nothing.
+var Discard Registry = discard{}
+
+// OrDiscard returns r, or Discard if r is nil.
+func OrDiscard(r Registry) Registry {
+	if r == nil {
+		return Discard
+	}
+	return r
+}
+
+type discard struct{}
+
+func (discard) Counter(string, ...string) Counter                { return discardMetric{} }
+func (discard) Gauge(string, ...string) Gauge                    { return discardMetric{} }
+func (discard) Histogram(string, []float64, ...string) Histogram { return discardMetric{} }
+
+type discardMetric struct{}
+
+func (discardMetric) Inc()            {}
+func (discardMetric) Dec()            {}
+func (discardMetric) Add(uint64)      {}
+func (discardMetric) Set(int64)       {}
+func (discardMetric) Observe(float64) {}
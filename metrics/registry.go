@@ -0,0 +1,227 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// StandardRegistry keeps metrics in memory, it is safe for concurrent use.
+type StandardRegistry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// family contains the metrics of one name, keyed by their labels.
+type family struct {
+	kind   string
+	series map[string]interface{}
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *StandardRegistry {
+	return &StandardRegistry{families: make(map[string]*family)}
+}
+
+func (r *StandardRegistry) Counter(name string, labels ...string) Counter {
+	return r.getOrCreate(name, kindCounter, labels, func() interface{} {
+		return new(counter)
+	}).(*counter)
+}
+
+func (r *StandardRegistry) Gauge(name string, labels ...string) Gauge {
+	return r.getOrCreate(name, kindGauge, labels, func() interface{} {
+		return new(gauge)
+	}).(*gauge)
+}
+
+func (r *StandardRegistry) Histogram(name string, buckets []float64, labels ...string) Histogram {
+	return r.getOrCreate(name, kindHistogram, labels, func() interface{} {
+		return newHistogram(buckets)
+	}).(*histogram)
+}
+
+// getOrCreate returns the metric of the given name and labels. Using one
+// name for different kinds of metrics or odd labels is a programming
+// error and panics.
+func (r *StandardRegistry) getOrCreate(name, kind string, labels []string, create func() interface{}) interface{} {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metrics: odd number of labels for %s", name))
+	}
+	key := formatLabels(labels)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, exists := r.families[name]
+	if !exists {
+		f = &family{kind: kind, series: make(map[string]interface{})}
+		r.families[name] = f
+	} else if f.kind != kind {
+		panic(fmt.Sprintf("metrics: %s registered as %s, not %s", name, f.kind, kind))
+	}
+	m, exists := f.series[key]
+	if !exists {
+		m = create()
+		f.series[key] = m
+	}
+	return m
+}
+
+// WritePrometheus writes all metrics in the Prometheus text format.
+func (r *StandardRegistry) WritePrometheus(w io.Writer) error {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	type entry struct {
+		labels string
+		metric interface{}
+	}
+	kinds := make(map[string]string, len(names))
+	snapshot := make(map[string][]entry, len(names))
+	for _, name := range names {
+		f := r.families[name]
+		entries := make([]entry, 0, len(f.series))
+		for labels, m := range f.series {
+			entries = append(entries, entry{labels, m})
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return entries[i].labels < entries[j].labels
+		})
+		kinds[name] = f.kind
+		snapshot[name] = entries
+	}
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, kinds[name])
+		for _, e := range snapshot[name] {
+			switch m := e.metric.(type) {
+			case *counter:
+				fmt.Fprintf(bw, "%s%s %d\n", name, e.labels, atomic.LoadUint64(&m.v))
+			case *gauge:
+				fmt.Fprintf(bw, "%s%s %d\n", name, e.labels, atomic.LoadInt64(&m.v))
+			case *histogram:
+				m.write(bw, name, e.labels)
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// formatLabels formats label pairs as {k1="v1",k2="v2"}.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// withLabel adds a label to a formatted label string.
+func withLabel(labels, key, value string) string {
+	pair := key + `="` + escapeLabel(value) + `"`
+	if labels == "" {
+		return "{" + pair + "}"
+	}
+	return labels[:len(labels)-1] + "," + pair + "}"
+}
+
+type counter struct {
+	v uint64
+}
+
+func (c *counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *counter) Add(delta uint64) {
+	atomic.AddUint64(&c.v, delta)
+}
+
+type gauge struct {
+	v int64
+}
+
+func (g *gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+func (g *gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	b := append([]float64{}, buckets...)
+	sort.Float64s(b)
+	return &histogram{buckets: b, counts: make([]uint64, len(b))}
+}
+
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		le := strconv.FormatFloat(bound, 'g', -1, 64)
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", le), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, withLabel(labels, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
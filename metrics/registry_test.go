@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStandardRegistry_writePrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("msgs_total", "protocol", "chat", "code", "1").Add(3)
+	r.Counter("msgs_total", "protocol", "chat", "code", "1").Inc()
+	r.Counter("msgs_total", "protocol", "base", "code", "2").Inc()
+	g := r.Gauge("peers", "type", "inbound")
+	g.Set(5)
+	g.Dec()
+	h := r.Histogram("latency_seconds", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(2)
+	want := `# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 2.55
+latency_seconds_count 3
+# TYPE msgs_total counter
+msgs_total{protocol="base",code="2"} 1
+msgs_total{protocol="chat",code="1"} 4
+# TYPE peers gauge
+peers{type="inbound"} 4
+`
+	buf := new(bytes.Buffer)
+	if err := r.WritePrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	rec := httptest.NewRecorder()
+	Handler(r).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if got := rec.Body.String(); got != want {
+		t.Fatalf("got handler body:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestStandardRegistry_kindMismatch(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("peers")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("registering a counter name as gauge should panic")
+		}
+	}()
+	r.Gauge("peers")
+}
@@ -0,0 +1,176 @@
+// Package netutil contains the IP network lists used to restrict the
+// addresses a node connects to and learns from node discovery, and the
+// limiters of its bandwidth.
+package netutil
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var (
+	errInvalid     = errors.New("invalid IP")
+	errUnspecified = errors.New("zero address")
+	errSpecial     = errors.New("special network")
+	errLoopback    = errors.New("loopback address from non-loopback host")
+	errLAN         = errors.New("LAN address from WAN host")
+)
+
+var lan4, lan6, special4, special6 Netlist
+
+func init() {
+	// Lists from RFC 5735, RFC 5156,
+	// https://www.iana.org/assignments/iana-ipv4-special-registry/
+	lan4.MustAdd("0.0.0.0/8")              // "This" network
+	lan4.MustAdd("10.0.0.0/8")             // Private Use
+	lan4.MustAdd("172.16.0.0/12")          // Private Use
+	lan4.MustAdd("192.168.0.0/16")         // Private Use
+	lan4.MustAdd("169.254.0.0/16")         // Link Local
+	lan6.MustAdd("fe80::/10")              // Link-Local
+	lan6.MustAdd("fc00::/7")               // Unique-Local
+	special4.MustAdd("192.0.0.0/29")       // IPv4 Service Continuity
+	special4.MustAdd("192.0.0.9/32")       // PCP Anycast
+	special4.MustAdd("192.0.0.170/32")     // NAT64/DNS64 Discovery
+	special4.MustAdd("192.0.0.171/32")     // NAT64/DNS64 Discovery
+	special4.MustAdd("192.0.2.0/24")       // TEST-NET-1
+	special4.MustAdd("192.31.196.0/24")    // AS112
+	special4.MustAdd("192.52.193.0/24")    // AMT
+	special4.MustAdd("192.88.99.0/24")     // 6to4 Relay Anycast
+	special4.MustAdd("192.175.48.0/24")    // AS112
+	special4.MustAdd("198.18.0.0/15")      // Device Benchmark Testing
+	special4.MustAdd("198.51.100.0/24")    // TEST-NET-2
+	special4.MustAdd("203.0.113.0/24")     // TEST-NET-3
+	special4.MustAdd("255.255.255.255/32") // Limited Broadcast
+	special6.MustAdd("100::/64")           // Discard-Only
+	special6.MustAdd("2001::/32")          // TEREDO
+	special6.MustAdd("2001:2::/48")        // Benchmarking
+	special6.MustAdd("2001:db8::/32")      // Documentation
+	special6.MustAdd("2002::/16")          // 6to4
+}
+
+// Netlist is a list of IP networks.
+type Netlist []net.IPNet
+
+// ParseNetlist parses a comma separated list of CIDR masks, whitespace
+// and extra commas are ignored.
+func ParseNetlist(s string) (*Netlist, error) {
+	ws := strings.NewReplacer(" ", "", "\n", "", "\t", "")
+	masks := strings.Split(ws.Replace(s), ",")
+	l := make(Netlist, 0)
+	for _, mask := range masks {
+		if mask == "" {
+			continue
+		}
+		_, n, err := net.ParseCIDR(mask)
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, *n)
+	}
+	return &l, nil
+}
+
+// Add parses a CIDR mask and appends it to the list.
+func (l *Netlist) Add(cidr string) error {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, *n)
+	return nil
+}
+
+// MustAdd is like Add but panics for invalid masks.
+func (l *Netlist) MustAdd(cidr string) {
+	if err := l.Add(cidr); err != nil {
+		panic(err)
+	}
+}
+
+// Contains reports whether the given IP is contained in the list,
+// a nil list contains nothing.
+func (l *Netlist) Contains(ip net.IP) bool {
+	if l == nil {
+		return false
+	}
+	for _, n := range *l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l Netlist) String() string {
+	masks := make([]string, len(l))
+	for i, n := range l {
+		masks[i] = n.String()
+	}
+	return strings.Join(masks, ",")
+}
+
+// Restriction limits the IPs a node talks to. Deny takes precedence
+// over Allow, an empty Allow list allows every network.
+type Restriction struct {
+	Allow Netlist
+	Deny  Netlist
+}
+
+// Permits reports whether the IP may be used, a nil restriction
+// permits every IP.
+func (r *Restriction) Permits(ip net.IP) bool {
+	if r == nil {
+		return true
+	}
+	if r.Deny.Contains(ip) {
+		return false
+	}
+	return len(r.Allow) == 0 || r.Allow.Contains(ip)
+}
+
+// IsLAN reports whether an IP is a local network address.
+func IsLAN(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return lan4.Contains(v4)
+	}
+	return lan6.Contains(ip)
+}
+
+// IsSpecialNetwork reports whether an IP is located in a special-use
+// network range, this includes broadcast, multicast and documentation
+// addresses.
+func IsSpecialNetwork(ip net.IP) bool {
+	if ip.IsMulticast() {
+		return true
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return special4.Contains(v4)
+	}
+	return special6.Contains(ip)
+}
+
+// CheckRelayIP reports whether an IP relayed from the given sender IP
+// is a valid connection target. LAN addresses are only accepted from
+// LAN hosts and loopback addresses only from loopback hosts.
+func CheckRelayIP(sender, addr net.IP) error {
+	if len(addr) != net.IPv4len && len(addr) != net.IPv6len {
+		return errInvalid
+	}
+	if addr.IsUnspecified() {
+		return errUnspecified
+	}
+	if IsSpecialNetwork(addr) {
+		return errSpecial
+	}
+	if addr.IsLoopback() && (sender == nil || !sender.IsLoopback()) {
+		return errLoopback
+	}
+	if IsLAN(addr) && (sender == nil || !IsLAN(sender)) {
+		return errLAN
+	}
+	return nil
+}
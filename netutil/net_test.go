@@ -0,0 +1,85 @@
+package netutil
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseNetlist(t *testing.T) {
+	l, err := ParseNetlist(" 10.0.0.0/8,, 2001:db8::/32 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := l.String(); got != "10.0.0.0/8,2001:db8::/32" {
+		t.Fatalf("got list: %s", got)
+	}
+	for ip, want := range map[string]bool{
+		"10.1.2.3":    true,
+		"11.0.0.1":    false,
+		"2001:db8::1": true,
+		"2001:db9::1": false,
+	} {
+		if got := l.Contains(net.ParseIP(ip)); got != want {
+			t.Fatalf("contains %s got: %v, want: %v", ip, got, want)
+		}
+	}
+	if _, err = ParseNetlist("10.0.0.0"); err == nil {
+		t.Fatal("parsed mask without prefix length")
+	}
+	var nilList *Netlist
+	if nilList.Contains(net.IP{10, 0, 0, 1}) {
+		t.Fatal("nil list contains ip")
+	}
+}
+
+func TestRestriction_permits(t *testing.T) {
+	r := new(Restriction)
+	r.Allow.MustAdd("10.0.0.0/8")
+	r.Deny.MustAdd("10.1.0.0/16")
+	for ip, want := range map[string]bool{
+		"10.0.0.1": true,
+		"10.1.0.1": false,
+		"11.0.0.1": false,
+	} {
+		if got := r.Permits(net.ParseIP(ip)); got != want {
+			t.Fatalf("permits %s got: %v, want: %v", ip, got, want)
+		}
+	}
+	deny := &Restriction{}
+	deny.Deny.MustAdd("10.0.0.0/8")
+	if deny.Permits(net.IP{10, 0, 0, 1}) || !deny.Permits(net.IP{11, 0, 0, 1}) {
+		t.Fatal("deny list without allow list not applied")
+	}
+	var nilRestriction *Restriction
+	if !nilRestriction.Permits(net.IP{10, 0, 0, 1}) {
+		t.Fatal("nil restriction denied ip")
+	}
+}
+
+func TestCheckRelayIP(t *testing.T) {
+	tests := []struct {
+		sender, addr string
+		want         error
+	}{
+		{"8.8.8.8", "1.2.3.4", nil},
+		{"8.8.8.8", "0.0.0.0", errUnspecified},
+		{"8.8.8.8", "255.255.255.255", errSpecial},
+		{"8.8.8.8", "224.0.0.1", errSpecial},
+		{"8.8.8.8", "127.0.0.1", errLoopback},
+		{"127.0.0.1", "127.0.0.1", nil},
+		{"8.8.8.8", "192.168.1.1", errLAN},
+		{"192.168.1.2", "192.168.1.1", nil},
+		{"127.0.0.1", "10.0.0.1", nil},
+		{"8.8.8.8", "fe80::1", errLAN},
+		{"8.8.8.8", "2001:db8::1", errSpecial},
+	}
+	for _, test := range tests {
+		err := CheckRelayIP(net.ParseIP(test.sender), net.ParseIP(test.addr))
+		if err != test.want {
+			t.Fatalf("relay %s from %s got err: %v, want: %v", test.addr, test.sender, err, test.want)
+		}
+	}
+	if err := CheckRelayIP(nil, net.IP{1, 2}); err != errInvalid {
+		t.Fatalf("got err: %v, want: %v", err, errInvalid)
+	}
+}
@@ -0,0 +1,135 @@
+package netutil
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// meterWindow is the time constant of the measured rate of a Limiter.
+const meterWindow = 5 * time.Second
+
+// RateLimit is a bandwidth limit in bytes per second for each direction
+// of traffic, zero does not limit the direction.
+type RateLimit struct {
+	Ingress int
+	Egress  int
+}
+
+// Limiter is a token bucket limiting a byte rate, the bucket holds the
+// tokens of one second. It also measures the rate of the bytes passing
+// it, a Limiter with zero rate only measures. A nil Limiter passes all
+// bytes without measuring them.
+type Limiter struct {
+	limit int
+	mu    sync.Mutex
+	// tokens may be negative after a large reservation, the debt is
+	// paid off before further bytes pass.
+	tokens float64
+	filled time.Time
+	total  uint64
+	// avg is the exponentially decaying rate at avgAt.
+	avg   float64
+	avgAt time.Time
+}
+
+// NewLimiter creates a limiter of rate bytes per second.
+func NewLimiter(rate int) *Limiter {
+	if rate < 0 {
+		rate = 0
+	}
+	now := time.Now()
+	return &Limiter{limit: rate, tokens: float64(rate), filled: now, avgAt: now}
+}
+
+// Reserve takes n bytes from the bucket and returns the time to wait
+// before they may be sent or processed.
+func (l *Limiter) Reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.measure(n, now)
+	if l.limit == 0 {
+		return 0
+	}
+	l.fill(now)
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.limit) * float64(time.Second))
+}
+
+// Allow takes n bytes from the bucket if there are enough tokens and
+// reports whether it did, bytes which are not allowed are not measured.
+func (l *Limiter) Allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit > 0 {
+		l.fill(now)
+		if l.tokens < float64(n) {
+			return false
+		}
+		l.tokens -= float64(n)
+	}
+	l.measure(n, now)
+	return true
+}
+
+func (l *Limiter) fill(now time.Time) {
+	l.tokens += now.Sub(l.filled).Seconds() * float64(l.limit)
+	if l.tokens > float64(l.limit) {
+		l.tokens = float64(l.limit)
+	}
+	l.filled = now
+}
+
+func (l *Limiter) measure(n int, now time.Time) {
+	l.avg = l.decayed(now) + float64(n)/meterWindow.Seconds()
+	l.avgAt = now
+	l.total += uint64(n)
+}
+
+func (l *Limiter) decayed(now time.Time) float64 {
+	elapsed := now.Sub(l.avgAt)
+	if elapsed <= 0 {
+		return l.avg
+	}
+	return l.avg * math.Exp(-elapsed.Seconds()/meterWindow.Seconds())
+}
+
+// Limit returns the rate limit in bytes per second, zero means unlimited.
+func (l *Limiter) Limit() int {
+	if l == nil {
+		return 0
+	}
+	return l.limit
+}
+
+// Rate returns the measured rate in bytes per second, it follows the
+// traffic of the last seconds.
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.decayed(time.Now())
+}
+
+// Total returns the number of bytes which passed the limiter.
+func (l *Limiter) Total() uint64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.total
+}
@@ -0,0 +1,45 @@
+package netutil
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter_reserve(t *testing.T) {
+	l := NewLimiter(1000)
+	if d := l.Reserve(1000); d != 0 {
+		t.Fatalf("got wait: %v within the burst", d)
+	}
+	// the debt of 500 bytes is paid off in half a second
+	if d := l.Reserve(500); d < 400*time.Millisecond || d > 500*time.Millisecond {
+		t.Fatalf("got wait: %v, want about: %v", d, 500*time.Millisecond)
+	}
+	if l.Allow(1) {
+		t.Fatal("allowed bytes while in debt")
+	}
+	if got := l.Total(); got != 1500 {
+		t.Fatalf("got total: %d, want: 1500", got)
+	}
+	if l.Rate() <= 0 {
+		t.Fatal("got no measured rate")
+	}
+}
+
+func TestLimiter_unlimited(t *testing.T) {
+	l := NewLimiter(0)
+	for i := 0; i < 10; i++ {
+		if d := l.Reserve(1 << 20); d != 0 {
+			t.Fatalf("got wait: %v without limit", d)
+		}
+	}
+	if !l.Allow(1 << 20) {
+		t.Fatal("unlimited limiter refused bytes")
+	}
+	if got := l.Total(); got != 11<<20 {
+		t.Fatalf("got total: %d, want: %d", got, 11<<20)
+	}
+	var nilLimiter *Limiter
+	if nilLimiter.Reserve(1) != 0 || !nilLimiter.Allow(1) || nilLimiter.Total() != 0 {
+		t.Fatal("nil limiter must pass bytes without measuring")
+	}
+}
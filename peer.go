@@ -2,17 +2,18 @@ package p2p
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"github.com/xfs-network/xlibp2p/discover"
 	"github.com/xfs-network/xlibp2p/log"
-	"io"
+	"github.com/xfs-network/xlibp2p/metrics"
 	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const pingloopinterval = 1
-const aliveloopinterval = 10
-const alivemaxinterval = 30
-
 
 type encoder interface {
 	Encode(obj interface{}) ([]byte, error)
@@ -20,12 +21,41 @@ type encoder interface {
 type Peer interface {
 	Is(flag int) bool
 	ID() discover.NodeId
+	Caps() []Cap
 	Close()
+	// Disconnect closes the peer and sends the reason to the remote side.
+	Disconnect(reason DiscReason)
+	// DiscReason returns why the peer was closed, it is only valid
+	// after CloseCh has been closed.
+	DiscReason() DiscReason
 	Run()
 	CloseCh() chan struct{}
-	Read(bs []byte) (int, error)
+	// WriteMessage queues a message for the writer goroutine of the peer.
+	// If the queue is full the SendPolicy of the server applies.
 	WriteMessage(mType uint8, data []byte) error
+	// WriteMessageContext is like WriteMessage but gives up waiting for
+	// room in the send queue once ctx is done. A queued message is skipped
+	// if ctx is done before it is written, and the deadline of ctx bounds
+	// the write. A write cut off by it disconnects the peer.
+	WriteMessageContext(ctx context.Context, mType uint8, data []byte) error
+	// TrySend queues a message without waiting, it returns
+	// ErrSendQueueFull if the send queue of the peer is full.
+	TrySend(mType uint8, data []byte) error
 	WriteMessageObj(mType uint8, data interface{}) error
+	// Report changes the score of the peer by delta, negative values
+	// report misbehavior. The peer is disconnected and banned when its
+	// score falls under the ban threshold of the server.
+	Report(delta float64, reason string)
+	// RTT returns the smoothed round-trip time of the heartbeat and its
+	// jitter, both are zero until the first response arrived.
+	RTT() (rtt time.Duration, jitter time.Duration)
+}
+
+// ProtocolPeer is the view of a peer passed to Protocol.Run. Message
+// types are relative to the protocol, and GetProtocolMsgCh delivers the
+// inbound messages of the protocol.
+type ProtocolPeer interface {
+	Peer
 	GetProtocolMsgCh() chan MessageReader
 }
 
@@ -34,12 +64,26 @@ type peer struct {
 	conn     *peerConn
 	rw       net.Conn
 	close    chan struct{}
+	// lastTime is the time of the last heartbeat response in unix nanoseconds.
 	lastTime int64
-	readBuf  bytes.Buffer
-	ps       []Protocol
+	rtt      rttEstimator
+	pingInterval time.Duration
+	// created is the time the handshakes completed.
+	created  time.Time
+	timeout  time.Duration
+	ps       []*protoRW
+	sendq    *sendQueue
+	traffic  *bandwidth
+	// counters are the traffic metrics of the base protocol.
+	counters *trafficCounters
 	quit     chan struct{}
-	psCh     chan MessageReader
+	closeOnce sync.Once
+	// discReason and discRemote are set once before close is closed.
+	discReason DiscReason
+	discRemote bool
+	wg       sync.WaitGroup
 	encoder encoder
+	metrics metrics.Registry
 	logger log.Logger
 }
 
@@ -50,13 +94,29 @@ func newPeer(conn *peerConn, ps []Protocol, en encoder) Peer {
 		id:    conn.id,
 		rw:    conn.rw,
 		logger: conn.logger,
-		ps:    ps,
 		close: make(chan struct{}),
-		psCh:  make(chan MessageReader),
 		encoder: en,
+		metrics: metrics.Discard,
+	}
+	config := Config{}
+	if conn.server != nil {
+		p.metrics = conn.server.metrics()
+		config = conn.server.config
+	}
+	p.pingInterval, p.timeout = config.PingInterval, config.PeerTimeout
+	if p.pingInterval <= 0 {
+		p.pingInterval = defaultPingInterval
+	}
+	if p.timeout <= 0 {
+		p.timeout = defaultPeerTimeout
 	}
+	p.sendq = newSendQueue(config)
+	p.traffic = newBandwidth(config.PeerRateLimit)
+	p.counters = newTrafficCounters(p.metrics, "base", baseProtocolLength)
+	p.ps = newProtoRWs(p, ps)
 	now := time.Now()
-	p.lastTime = now.Unix()
+	p.lastTime = now.UnixNano()
+	p.created = now
 	return p
 }
 
@@ -64,6 +124,11 @@ func (p *peer) ID() discover.NodeId {
 	return p.id
 }
 
+// Caps returns the protocols announced by the remote peer.
+func (p *peer) Caps() []Cap {
+	return p.conn.caps
+}
+
 func (p *peer) CloseCh() chan struct{} {
 	return p.close
 }
@@ -78,8 +143,28 @@ func (p *peer) readLoop() {
 			return
 		default:
 		}
-		msg, err := ReadMessage(p.rw)
+		msg, err := readMessage(p.rw, p.maxMsgSize)
+		if err == nil {
+			err = p.conn.decompress(msg, p.maxMsgSize(msg.mType))
+		}
+		if errors.Is(err, errBadCompression) {
+			p.logger.Warnf("peer %s sent invalid compressed message: %v", p.id, err)
+			p.Report(ScoreProtocolError, "invalid compressed message")
+			p.Disconnect(DiscProtocolError)
+			return
+		}
+		if errors.Is(err, errMsgTooLarge) {
+			p.logger.Warnf("peer %s sent oversized message: %v", p.id, err)
+			p.Report(ScoreOversizedMessage, "oversized message")
+			p.Disconnect(DiscProtocolError)
+			return
+		}
 		if err != nil {
+			p.closeWith(DiscNetworkError, false)
+			return
+		}
+		// holding up the read loop slows down the remote side
+		if !throttle(msg.wireSize, p.close, p.limiters(msg.mType, false)...) {
 			return
 		}
 		p.handle(msg)
@@ -92,39 +177,175 @@ func (p *peer) handle(msg MessageReader) {
 		return
 	}
 	//p.logger.Infof("peer handle message type %d, data: %s", msg.Type(), string(data))
+	p.countTraffic("ingress", msg.Type(), len(data))
 	switch msg.Type() {
 	case typePingMsg:
 		p.logger.Debugln("receive heartbeat request")
-		err = p.conn.writeMessage(typePongMsg, []byte("hello"))
-		if err != nil {
-			p.Close()
-		}
+		// the pong echoes the nonce and timestamp of the ping, a pong
+		// dropped from a full queue is made up for by the next one
+		_ = p.WriteMessage(typePongMsg, data)
+	case typeDiscMsg:
+		p.closeWith(decodeDiscReason(data), true)
 	case typePongMsg:
 		p.logger.Debugln("receive response of heartbeat and update alive time")
 		now := time.Now()
-		p.lastTime = now.Unix()
+		atomic.StoreInt64(&p.lastTime, now.UnixNano())
+		if rtt, ok := p.rtt.pong(now, data); ok {
+			p.metrics.Histogram("p2p_peer_rtt_seconds", metrics.DefBuckets).Observe(rtt.Seconds())
+		}
 	default:
-		bodyBs := msg.RawReader()
+		rw := p.protoRW(msg.Type())
+		if rw == nil {
+			p.logger.Debugf("peer got message of unknown type %d", msg.Type())
+			p.Report(ScoreProtocolError, "unknown message type")
+			p.Disconnect(DiscProtocolError)
+			return
+		}
 		cpy := &messageReader{
-			raw:   bodyBs,
-			mType: msg.Type(),
-			data:  bytes.NewReader(data),
+			raw:     msg.RawReader(),
+			mType:   msg.Type() - rw.offset,
+			data:    bytes.NewReader(data),
+			payload: data,
+		}
+		// a full queue must not hold up the read loop and with it the
+		// heartbeat and the other protocols. Dropping the message would
+		// break protocols relying on the stream, so the peer is
+		// disconnected instead, it is not blamed for our slowness
+		select {
+		case rw.in <- cpy:
+		default:
+			p.logger.Infof("protocol %s does not keep up with peer %s", rw.proto.Name(), p.id)
+			p.metrics.Counter("p2p_protocol_queue_overflows_total", "protocol", rw.proto.Name()).Inc()
+			p.Disconnect(DiscQueueOverflow)
+			return
+		}
+		p.emit(&PeerEvent{
+			Type:     PeerEventTypeMsgRecv,
+			Peer:     p.id,
+			Protocol: rw.proto.Name(),
+			MsgCode:  cpy.mType,
+			MsgSize:  uint32(len(data)),
+		})
+	}
+}
+
+// maxMsgSize returns the size limit of messages of the given type.
+func (p *peer) maxMsgSize(mType uint8) uint32 {
+	if rw := p.protoRW(mType); rw != nil {
+		return rw.maxSize
+	}
+	return baseMaxMsgSize
+}
+
+// protoRW returns the protocol which owns the given message type.
+func (p *peer) protoRW(mType uint8) *protoRW {
+	for _, rw := range p.ps {
+		if mType >= rw.offset && mType-rw.offset < rw.proto.Length() {
+			return rw
 		}
-		p.psCh <- cpy
-		_, _ = io.Copy(&p.readBuf, bodyBs)
 	}
+	return nil
 }
 
-func (p *peer) Read(bs []byte) (int, error) {
-	return p.readBuf.Read(bs)
+// emit sends an event to the subscribers of the server, if there is one.
+func (p *peer) emit(ev *PeerEvent) {
+	if p.conn.server != nil {
+		p.conn.server.events.send(ev)
+	}
 }
 
-func (p *peer) GetProtocolMsgCh() chan MessageReader {
-	return p.psCh
+func (p *peer) Report(delta float64, reason string) {
+	if p.conn.server == nil || !p.conn.server.scores.report(p.id, p.conn.remoteIP(), delta) {
+		return
+	}
+	p.logger.Infof("peer %s banned: %s", p.id, reason)
+	p.metrics.Counter("p2p_bans_total").Inc()
+	p.emit(&PeerEvent{Type: PeerEventTypeBanned, Peer: p.id, Reason: reason})
+	p.Disconnect(DiscBanned)
 }
 
 func (p *peer) WriteMessage(mType uint8, bs []byte) error {
-	return p.conn.writeMessage(mType, bs)
+	return p.WriteMessageContext(context.Background(), mType, bs)
+}
+
+func (p *peer) WriteMessageContext(ctx context.Context, mType uint8, bs []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return p.send(ctx, mType, bs)
+}
+
+// countTraffic records a message in the traffic metrics, the message
+// type is reported relative to the protocol which owns it.
+func (p *peer) countTraffic(direction string, mType uint8, size int) {
+	if mType < baseProtocolLength {
+		p.counters.count(direction, mType, size)
+		return
+	}
+	if rw := p.protoRW(mType); rw != nil {
+		rw.counters.count(direction, mType-rw.offset, size)
+		return
+	}
+	// messages of unknown types are rare, they are not cached
+	newMsgCounters(p.metrics, direction, "unknown", mType).add(size)
+}
+
+// msgCounters are the traffic metrics of one message code and direction.
+type msgCounters struct {
+	messages metrics.Counter
+	bytes    metrics.Counter
+}
+
+func newMsgCounters(registry metrics.Registry, direction, protocol string, code uint8) *msgCounters {
+	labels := []string{"protocol", protocol, "code", strconv.Itoa(int(code))}
+	return &msgCounters{
+		messages: registry.Counter("p2p_"+direction+"_messages_total", labels...),
+		bytes:    registry.Counter("p2p_"+direction+"_bytes_total", labels...),
+	}
+}
+
+func (c *msgCounters) add(size int) {
+	c.messages.Inc()
+	c.bytes.Add(uint64(size))
+}
+
+// trafficCounters caches the traffic metrics of the message codes of a
+// protocol, so the hot paths do not look them up in the registry. The
+// metrics of a code are resolved on its first message.
+type trafficCounters struct {
+	registry metrics.Registry
+	protocol string
+	// ingress and egress hold a *msgCounters for each code.
+	ingress []atomic.Value
+	egress  []atomic.Value
+}
+
+func newTrafficCounters(registry metrics.Registry, protocol string, length uint8) *trafficCounters {
+	return &trafficCounters{
+		registry: registry,
+		protocol: protocol,
+		ingress:  make([]atomic.Value, length),
+		egress:   make([]atomic.Value, length),
+	}
+}
+
+func (c *trafficCounters) count(direction string, code uint8, size int) {
+	codes := c.ingress
+	if direction == "egress" {
+		codes = c.egress
+	}
+	if int(code) >= len(codes) {
+		newMsgCounters(c.registry, direction, c.protocol, code).add(size)
+		return
+	}
+	// concurrent first messages may both resolve the metrics, the registry
+	// returns the same counters to them
+	mc, _ := codes[code].Load().(*msgCounters)
+	if mc == nil {
+		mc = newMsgCounters(c.registry, direction, c.protocol, code)
+		codes[code].Store(mc)
+	}
+	mc.add(size)
 }
 
 func (p *peer) WriteMessageObj(mType uint8, obj interface{}) error {
@@ -137,67 +358,106 @@ func (p *peer) WriteMessageObj(mType uint8, obj interface{}) error {
 }
 
 func (p *peer) pingLoop() {
-	ping := time.NewTicker(pingloopinterval * time.Second)
+	ping := time.NewTicker(p.pingInterval)
 	defer ping.Stop()
 	for {
 		select {
 		case <-ping.C:
-			if err := p.conn.writeMessage(typePingMsg, []byte("hello")); err != nil {
-				p.Close()
-				return
-			}
+			// a dead peer is closed by suicide, not by a full queue
+			_ = p.WriteMessage(typePingMsg, p.rtt.ping(time.Now(), p.timeout))
 		case <-p.close:
 			return
 		}
 	}
 }
 
-func (p *peer) suicide(timout chan struct{}) {
-	defer close(timout)
+// suicide closes the peer when no heartbeat response arrived in time.
+func (p *peer) suicide() {
+	alive := time.NewTicker(p.timeout / 3)
+	defer alive.Stop()
 	for {
 		select {
+		case <-alive.C:
+			interval := time.Since(time.Unix(0, atomic.LoadInt64(&p.lastTime)))
+			if interval > p.timeout {
+				p.logger.Debugln("peer stop running because of timeout")
+				p.Disconnect(DiscTimeout)
+				return
+			}
 		case <-p.close:
 			return
-		default:
 		}
-		now := time.Now()
-		nowTime := now.Unix()
-		interval := nowTime - p.lastTime
-		// 10s
-		if interval > alivemaxinterval {
-			p.logger.Debugln("peer stop running because of timeout")
-			p.Close()
-			break
-		}
-		time.Sleep(aliveloopinterval * time.Second)
 	}
 }
 
+// Run starts the loops and the protocols of the peer and blocks until the
+// peer is closed and all of them have returned.
 func (p *peer) Run() {
-	go p.readLoop()
-	go p.pingLoop()
-	runProtocol := func() {
-		for _, item := range p.ps {
-			go func(p *peer, item Protocol) {
-				err := item.Run(p)
-				if err != nil {
-					p.Close()
-				}
-			}(p, item)
-		}
+	p.wg.Add(4)
+	go func() {
+		defer p.wg.Done()
+		p.readLoop()
+	}()
+	go func() {
+		defer p.wg.Done()
+		p.writeLoop()
+	}()
+	go func() {
+		defer p.wg.Done()
+		p.pingLoop()
+	}()
+	go func() {
+		defer p.wg.Done()
+		p.suicide()
+	}()
+	for _, item := range p.ps {
+		p.wg.Add(1)
+		go func(p *peer, rw *protoRW) {
+			defer p.wg.Done()
+			err := rw.proto.Run(rw)
+			if err != nil {
+				p.logger.Warnf("protocol %s/%d of peer %s err: %v",
+					rw.proto.Name(), rw.proto.Version(), p.id, err)
+				p.Report(ScoreProtocolError, "protocol error")
+				p.Disconnect(DiscProtocolError)
+			}
+		}(p, item)
 	}
-	runProtocol()
-	timout := make(chan struct{})
-	go p.suicide(timout)
-loop:
-	for {
-		select {
-		case <-timout:
-			break loop
-		}
+	<-p.close
+	if p.discRemote {
+		p.logger.Infof("peer %s disconnected by remote: %v", p.id, p.discReason)
+	} else {
+		p.logger.Infof("peer %s disconnected: %v", p.id, p.discReason)
+		p.conn.disconnect(p.discReason)
 	}
+	// unblock the read loop and pending writes
+	p.conn.close()
+	p.wg.Wait()
 }
 
+// Close stops the peer, it is safe to call it more than once.
 func (p *peer) Close() {
-	close(p.close)
+	p.Disconnect(DiscRequested)
+}
+
+// Disconnect stops the peer and tells the remote side why, only the
+// first reason is kept if it is called more than once.
+func (p *peer) Disconnect(reason DiscReason) {
+	p.closeWith(reason, false)
+}
+
+func (p *peer) closeWith(reason DiscReason, remote bool) {
+	p.closeOnce.Do(func() {
+		p.discReason = reason
+		p.discRemote = remote
+		close(p.close)
+	})
+}
+
+func (p *peer) RTT() (time.Duration, time.Duration) {
+	return p.rtt.get()
+}
+
+func (p *peer) DiscReason() DiscReason {
+	return p.discReason
 }
@@ -0,0 +1,432 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/xfs-network/xlibp2p/log"
+	"github.com/xfs-network/xlibp2p/metrics"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestMessage(t *testing.T, mType uint8, data []byte) MessageReader {
+	raw := []byte{version2, mType, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(raw[2:], uint32(len(data)))
+	msg, err := ReadMessage(bytes.NewReader(append(raw, data...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestPeer_handleProtocolMessages(t *testing.T) {
+	conn := &peerConn{logger: log.DefaultLogger()}
+	a := &testProtocol{name: "a", version: 1, length: 2}
+	b := &testProtocol{name: "b", version: 1, length: 3}
+	p := newPeer(conn, []Protocol{a, b}, nil).(*peer)
+	if len(p.ps) != 2 {
+		t.Fatalf("got protocols: %d, want: 2", len(p.ps))
+	}
+	rwA, rwB := p.ps[0], p.ps[1]
+	if rwA.offset != baseProtocolLength || rwB.offset != baseProtocolLength+2 {
+		t.Fatalf("got offsets: %d, %d", rwA.offset, rwB.offset)
+	}
+	p.handle(newTestMessage(t, baseProtocolLength+1, []byte("to a")))
+	p.handle(newTestMessage(t, baseProtocolLength+2, []byte("to b")))
+	assertMsg := func(rw *protoRW, wantType uint8, want string) {
+		select {
+		case msg := <-rw.GetProtocolMsgCh():
+			got, err := msg.ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if msg.Type() != wantType || string(got) != want {
+				t.Fatalf("protocol %s got type: %d, data: %s, want type: %d, data: %s",
+					rw.proto.Name(), msg.Type(), got, wantType, want)
+			}
+		default:
+			t.Fatalf("protocol %s got no message", rw.proto.Name())
+		}
+	}
+	assertMsg(rwA, 1, "to a")
+	assertMsg(rwB, 0, "to b")
+	if len(rwA.in) != 0 || len(rwB.in) != 0 {
+		t.Fatal("unexpected message in protocol queue")
+	}
+	if err := rwA.WriteMessage(2, nil); err != errInvalidMsgType {
+		t.Fatalf("got err: %v, want: %v", err, errInvalidMsgType)
+	}
+	// unknown message types are a breach of protocol
+	p.handle(newTestMessage(t, baseProtocolLength+5, []byte("to nobody")))
+	select {
+	case <-p.CloseCh():
+	default:
+		t.Fatal("peer not closed after unknown message type")
+	}
+	if p.DiscReason() != DiscProtocolError {
+		t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscProtocolError)
+	}
+}
+
+func TestPeer_handleDiscMsg(t *testing.T) {
+	conn := &peerConn{logger: log.DefaultLogger()}
+	p := newPeer(conn, nil, nil).(*peer)
+	p.handle(newTestMessage(t, typeDiscMsg, []byte{uint8(DiscTooManyPeers)}))
+	select {
+	case <-p.CloseCh():
+	default:
+		t.Fatal("peer not closed after disconnect message")
+	}
+	if p.DiscReason() != DiscTooManyPeers || !p.discRemote {
+		t.Fatalf("got disconnect reason: %v, remote: %v, want: %v from remote",
+			p.DiscReason(), p.discRemote, DiscTooManyPeers)
+	}
+	// later reasons are ignored
+	p.Disconnect(DiscQuitting)
+	if p.DiscReason() != DiscTooManyPeers {
+		t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscTooManyPeers)
+	}
+}
+
+type limitedProtocol struct {
+	*testProtocol
+	maxSize uint32
+}
+
+func (lp *limitedProtocol) MaxMsgSize() uint32 {
+	return lp.maxSize
+}
+
+func TestPeer_oversizedMessage(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &peerConn{logger: log.DefaultLogger(), rw: local, version: version2}
+	proto := &limitedProtocol{&testProtocol{name: "a", version: 1, length: 1}, 8}
+	p := newPeer(conn, []Protocol{proto}, nil).(*peer)
+	if err := p.ps[0].WriteMessage(0, make([]byte, 9)); !errors.Is(err, errMsgTooLarge) {
+		t.Fatalf("got write err: %v, want: %v", err, errMsgTooLarge)
+	}
+	go p.readLoop()
+	// only the header is sent, the announced size alone must be rejected
+	header := []byte{version2, baseProtocolLength, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(header[2:], 9)
+	if _, err := remote.Write(header); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.CloseCh():
+	case <-time.After(time.Second):
+		t.Fatal("peer not closed after oversized message")
+	}
+	if p.DiscReason() != DiscProtocolError {
+		t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscProtocolError)
+	}
+}
+
+func TestPeer_writeMessageContext(t *testing.T) {
+	conn := &peerConn{logger: log.DefaultLogger()}
+	p := newPeer(conn, nil, nil).(*peer)
+	p.sendq = newSendQueue(Config{SendQueueSize: 1})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := p.WriteMessageContext(ctx, baseProtocolLength, nil); err != context.Canceled {
+		t.Fatalf("got err: %v, want: %v", err, context.Canceled)
+	}
+	if err := p.WriteMessage(baseProtocolLength, nil); err != nil {
+		t.Fatal(err)
+	}
+	// the writer is not running, the write waits for room until the deadline
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := p.WriteMessageContext(ctx, baseProtocolLength, nil); err != context.DeadlineExceeded {
+		t.Fatalf("got err: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	if err := p.TrySend(baseProtocolLength, nil); err != ErrSendQueueFull {
+		t.Fatalf("got err: %v, want: %v", err, ErrSendQueueFull)
+	}
+	// control messages have their own queue
+	if err := p.TrySend(typePingMsg, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.CloseCh():
+		t.Fatal("peer closed by a full queue with the block policy")
+	default:
+	}
+	p.Close()
+	if err := p.WriteMessage(baseProtocolLength, nil); err != errPeerClosed {
+		t.Fatalf("got err: %v, want: %v", err, errPeerClosed)
+	}
+}
+
+func TestPeer_sendPolicy(t *testing.T) {
+	tests := []struct {
+		policy SendPolicy
+		closed bool
+	}{
+		{SendDrop, false},
+		{SendDisconnect, true},
+	}
+	for _, test := range tests {
+		conn := &peerConn{logger: log.DefaultLogger()}
+		p := newPeer(conn, nil, nil).(*peer)
+		p.sendq = newSendQueue(Config{SendQueueSize: 1, SendPolicy: test.policy})
+		if err := p.WriteMessage(baseProtocolLength, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.WriteMessage(baseProtocolLength, nil); err != ErrSendQueueFull {
+			t.Fatalf("policy %v got err: %v, want: %v", test.policy, err, ErrSendQueueFull)
+		}
+		closed := false
+		select {
+		case <-p.CloseCh():
+			closed = true
+		default:
+		}
+		if closed != test.closed {
+			t.Fatalf("policy %v got closed: %v, want: %v", test.policy, closed, test.closed)
+		}
+		if closed && p.DiscReason() != DiscSlowPeer {
+			t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscSlowPeer)
+		}
+	}
+}
+
+func TestPeer_writeLoop(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &peerConn{logger: log.DefaultLogger(), rw: local, version: version2}
+	p := newPeer(conn, nil, nil).(*peer)
+	p.sendq = newSendQueue(Config{WriteTimeout: 100 * time.Millisecond})
+	for i := 0; i < 2; i++ {
+		if err := p.WriteMessage(baseProtocolLength, []byte("data")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.WriteMessage(typePingMsg, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.writeLoop()
+	}()
+	// queued control messages go first
+	for _, want := range []uint8{typePingMsg, baseProtocolLength} {
+		msg, err := ReadMessage(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type() != want {
+			t.Fatalf("got message type: %d, want: %d", msg.Type(), want)
+		}
+	}
+	// nobody reads the last message, the write times out
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("write loop did not stop after a write timeout")
+	}
+	if p.DiscReason() != DiscNetworkError {
+		t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscNetworkError)
+	}
+}
+
+func TestPeer_compressedMessages(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	codec := lookupCodec("snappy")
+	conn := &peerConn{logger: log.DefaultLogger(), rw: local, version: version2, codec: codec}
+	proto := &testProtocol{name: "a", version: 1, length: 1}
+	p := newPeer(conn, []Protocol{proto}, nil).(*peer)
+	go p.readLoop()
+	sender := &peerConn{logger: log.DefaultLogger(), rw: remote, version: version2, codec: codec, compressMin: 64}
+	data := bytes.Repeat([]byte("compressible "), 100)
+	go func() { _ = sender.writeMessage(baseProtocolLength, data) }()
+	select {
+	case msg := <-p.ps[0].in:
+		got, err := msg.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatal("got different data after decompression")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("compressed message not delivered")
+	}
+	// a message decompressing beyond the limit of the protocol is rejected
+	go func() { _ = sender.writeMessage(baseProtocolLength, make([]byte, defaultMaxMsgSize+1)) }()
+	select {
+	case <-p.CloseCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not closed after oversized compressed message")
+	}
+	if p.DiscReason() != DiscProtocolError {
+		t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscProtocolError)
+	}
+}
+
+func TestPeer_heartbeat(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &peerConn{logger: log.DefaultLogger(), rw: local, version: version2}
+	p := newPeer(conn, nil, nil).(*peer)
+	p.pingInterval, p.timeout = 10*time.Millisecond, 300*time.Millisecond
+	go p.Run()
+	// answer the first pings late, then stop answering
+	for i := 0; i < 3; i++ {
+		msg, err := ReadMessage(remote)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := msg.ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.Type() != typePingMsg {
+			continue
+		}
+		time.Sleep(20 * time.Millisecond)
+		raw := []byte{version2, typePongMsg, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(raw[2:], uint32(len(data)))
+		if _, err = remote.Write(append(raw, data...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		for {
+			if _, err := ReadMessage(remote); err != nil {
+				return
+			}
+		}
+	}()
+	select {
+	case <-p.CloseCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not closed after heartbeat timeout")
+	}
+	if p.DiscReason() != DiscTimeout {
+		t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscTimeout)
+	}
+	if rtt, _ := p.RTT(); rtt < 20*time.Millisecond {
+		t.Fatalf("got rtt: %v, want at least: %v", rtt, 20*time.Millisecond)
+	}
+}
+
+func TestPeer_protocolQueueFull(t *testing.T) {
+	conn := &peerConn{logger: log.DefaultLogger()}
+	a := &testProtocol{name: "a", version: 1, length: 1}
+	b := &testProtocol{name: "b", version: 1, length: 1}
+	p := newPeer(conn, []Protocol{a, b}, nil).(*peer)
+	for i := 0; i < protocolMsgQueueSize; i++ {
+		p.handle(newTestMessage(t, baseProtocolLength, []byte("to a")))
+	}
+	// nobody reads the queue of a, the other protocols are not held up
+	p.handle(newTestMessage(t, baseProtocolLength+1, []byte("to b")))
+	if len(p.ps[0].in) != protocolMsgQueueSize || len(p.ps[1].in) != 1 {
+		t.Fatalf("got queued messages: %d, %d", len(p.ps[0].in), len(p.ps[1].in))
+	}
+	select {
+	case <-p.CloseCh():
+		t.Fatal("peer closed before the queue overflowed")
+	default:
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.handle(newTestMessage(t, baseProtocolLength, []byte("to a")))
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("full protocol queue blocked the peer")
+	}
+	select {
+	case <-p.CloseCh():
+	case <-time.After(time.Second):
+		t.Fatal("peer not disconnected after the queue overflowed")
+	}
+	if p.DiscReason() != DiscQueueOverflow {
+		t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscQueueOverflow)
+	}
+}
+
+func TestPeer_writeDeadline(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := &peerConn{logger: log.DefaultLogger(), rw: local, version: version2}
+	p := newPeer(conn, nil, nil).(*peer)
+	// a message whose context is done before it is written is skipped
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := p.WriteMessageContext(ctx, baseProtocolLength, []byte("skipped")); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := p.WriteMessage(baseProtocolLength+1, []byte("written")); err != nil {
+		t.Fatal(err)
+	}
+	go p.writeLoop()
+	msg, err := ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != baseProtocolLength+1 {
+		t.Fatalf("got message type: %d, want: %d", msg.Type(), baseProtocolLength+1)
+	}
+	// nobody reads, the deadline of the context cuts off the write long
+	// before the write timeout
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = p.WriteMessageContext(ctx, baseProtocolLength, []byte("blocked")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.CloseCh():
+	case <-time.After(5 * time.Second):
+		t.Fatal("peer not closed after the write deadline")
+	}
+	if p.DiscReason() != DiscNetworkError {
+		t.Fatalf("got disconnect reason: %v, want: %v", p.DiscReason(), DiscNetworkError)
+	}
+}
+
+// lookupRegistry counts the lookups of counters.
+type lookupRegistry struct {
+	*metrics.StandardRegistry
+	lookups int
+}
+
+func (r *lookupRegistry) Counter(name string, labels ...string) metrics.Counter {
+	r.lookups++
+	return r.StandardRegistry.Counter(name, labels...)
+}
+
+func TestTrafficCounters(t *testing.T) {
+	reg := &lookupRegistry{StandardRegistry: metrics.NewRegistry()}
+	c := newTrafficCounters(reg, "test", 2)
+	for i := 0; i < 10; i++ {
+		c.count("ingress", 1, 3)
+		c.count("egress", 1, 3)
+	}
+	// the messages and bytes counters are looked up once per direction
+	if reg.lookups != 4 {
+		t.Fatalf("got %d counter lookups, want 4", reg.lookups)
+	}
+	var buf bytes.Buffer
+	if err := reg.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`p2p_ingress_messages_total{protocol="test",code="1"} 10`,
+		`p2p_egress_bytes_total{protocol="test",code="1"} 30`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("missing %s in:\n%s", want, buf.String())
+		}
+	}
+}
@@ -3,15 +3,24 @@ package p2p
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/xfs-network/xlibp2p/crypto"
 	"github.com/xfs-network/xlibp2p/discover"
 	"github.com/xfs-network/xlibp2p/log"
+	"github.com/xfs-network/xlibp2p/metrics"
+	"io"
 	"io/ioutil"
 	"net"
+	"sync"
+	"time"
 )
 
+// handshakeTimeout bounds the time spent on the handshake of a new connection.
+const handshakeTimeout = 5 * time.Second
+
 // Peer to peer connection session
 type peerConn struct {
 	logger log.Logger
@@ -24,27 +33,76 @@ type peerConn struct {
 	version         uint8
 	handshakeStatus int
 	flag int
+	// caps contains the protocols announced by the remote side.
+	caps []Cap
+	// wmu serializes the writes and the write deadlines of rw.
+	wmu sync.Mutex
+	// codec compresses protocol messages of at least compressMin bytes,
+	// it is nil if the protocol handshake found no common codec.
+	codec       Codec
+	compressMin uint32
 }
 
-func (c *peerConn) serve() {
+// serve runs the handshakes and hands the connection to the server,
+// it returns the error of a failed handshake.
+func (c *peerConn) serve() error {
 	// Get the address and port number of the client
 	fromAddr := c.rw.RemoteAddr()
 	inbound := c.flag & flagInbound != 0
+	start := time.Now()
+	_ = c.rw.SetDeadline(start.Add(handshakeTimeout))
 	if inbound {
 		if err := c.serverHandshake(); err != nil {
 			c.logger.Warnf("handshake error from %s: %v", fromAddr, err)
-			c.close()
-			return
+			c.handshakeFailed(err)
+			return err
 		}
 	} else {
 		if err := c.clientHandshake(); err != nil {
 			c.logger.Warnf("handshake error from %s: %v", fromAddr, err)
-			c.close()
-			return
+			c.handshakeFailed(err)
+			return err
 		}
 	}
+	if err := c.protoHandshake(); err != nil {
+		c.logger.Warnf("protocol handshake error from %s: %v", fromAddr, err)
+		c.handshakeFailed(err)
+		return err
+	}
+	_ = c.rw.SetDeadline(time.Time{})
+	reg := c.server.metrics()
+	reg.Counter("p2p_handshakes_total", "direction", c.direction(), "result", "success").Inc()
+	reg.Histogram("p2p_handshake_duration_seconds", metrics.DefBuckets,
+		"direction", c.direction()).Observe(time.Since(start).Seconds())
 	c.logger.Infof("p2p handshake success by %s", fromAddr)
-	c.server.addpeer <- c
+	select {
+	case c.server.addpeer <- c:
+	case <-c.server.close:
+		c.close()
+	}
+	return nil
+}
+
+// direction returns "inbound" or "outbound", it is used in metrics.
+func (c *peerConn) direction() string {
+	if c.flag&flagInbound != 0 {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// handshakeFailed closes the connection and emits a handshake failed event,
+// the id is only known if it was dialed or the hello was received.
+func (c *peerConn) handshakeFailed(err error) {
+	c.close()
+	c.server.metrics().Counter("p2p_handshakes_total",
+		"direction", c.direction(), "result", "failure").Inc()
+	c.server.events.send(&PeerEvent{
+		Type:       PeerEventTypeHandshakeFailed,
+		Peer:       c.id,
+		RemoteAddr: c.rw.RemoteAddr().String(),
+		Error:      err.Error(),
+	})
 }
 
 //Client handshake sending method
@@ -54,13 +112,24 @@ func (c *peerConn) clientHandshake() error {
 	if c.handshakeCompiled() {
 		return nil
 	}
+	ephemeral, err := crypto.GenPrvKey()
+	if err != nil {
+		return err
+	}
 	request := &helloRequestMsg{
-		version:   c.version,
-		id:        c.self,
-		receiveId: c.id,
+		version:      c.version,
+		id:           c.self,
+		receiveId:    c.id,
+		ephemeralKey: discover.PubKey2NodeId(ephemeral.PublicKey),
+	}
+	if _, err = rand.Read(request.nonce[:]); err != nil {
+		return err
+	}
+	if request.sign, err = crypto.ECDSASign(request.sigHash(), c.key); err != nil {
+		return err
 	}
 	c.logger.Debugf("send hello request version: %d, id: %s, to receiveId: %s", c.version,c.self, c.id)
-	_, err := c.rw.Write(request.marshal())
+	_, err = c.rw.Write(request.marshal())
 	if err != nil {
 		return err
 	}
@@ -80,6 +149,16 @@ func (c *peerConn) clientHandshake() error {
 		return fmt.Errorf("handshake check err got my name: 0x%x, my real name: 0x%x",
 			gotId, wantId)
 	}
+	if !bytes.Equal(hello.id[:], c.id[:]) {
+		return fmt.Errorf("handshake check err got remote name: 0x%x, want: 0x%x",
+			hello.id, c.id)
+	}
+	if err = verifyHello(hello.id, hello.sigHash(request.nonce[:]), hello.sign); err != nil {
+		return err
+	}
+	if err = c.secure(ephemeral, hello.ephemeralKey, request.nonce[:], hello.nonce[:], true); err != nil {
+		return err
+	}
 	c.handshakeStatus = 1
 	return nil
 }
@@ -107,17 +186,123 @@ func (c *peerConn) serverHandshake() error {
 		return fmt.Errorf("handshake check err got my name: 0x%x, my real name: 0x%x",
 			gotId, wantId)
 	}
+	if err = verifyHello(hello.id, hello.sigHash(), hello.sign); err != nil {
+		return err
+	}
+	if bytes.Equal(hello.id[:], c.self[:]) {
+		return DiscSelf
+	}
 	c.id = hello.id
 
+	ephemeral, err := crypto.GenPrvKey()
+	if err != nil {
+		return err
+	}
 	reply := &helloReRequestMsg{
-		id:        c.self,
-		receiveId: hello.id,
-		version:   c.version,
+		id:           c.self,
+		receiveId:    hello.id,
+		version:      c.version,
+		ephemeralKey: discover.PubKey2NodeId(ephemeral.PublicKey),
+	}
+	if _, err = rand.Read(reply.nonce[:]); err != nil {
+		return err
+	}
+	if reply.sign, err = crypto.ECDSASign(reply.sigHash(hello.nonce[:]), c.key); err != nil {
+		return err
 	}
 	c.logger.Debugf("send handshake reply to nodeId %s", reply.receiveId)
 	if _, err = c.rw.Write(reply.marshal()); err != nil {
 		return err
 	}
+	if err = c.secure(ephemeral, hello.ephemeralKey, hello.nonce[:], reply.nonce[:], false); err != nil {
+		return err
+	}
+	c.handshakeStatus = 1
+	return nil
+}
+
+// protoHandshake exchanges the supported protocols with the remote side.
+// Both sides send their message first, so it is written in its own goroutine.
+func (c *peerConn) protoHandshake() error {
+	ours := &protoHandshakeMsg{
+		caps:   protocolCaps(c.server.protocols),
+		codecs: c.server.codecNames(),
+	}
+	werr := make(chan error, 1)
+	go func() {
+		werr <- c.writeMessage(typeProtoHandshake, ours.marshal())
+	}()
+	msg, err := c.readMessage()
+	if err != nil {
+		return err
+	}
+	data, err := msg.ReadAll()
+	if err != nil {
+		return err
+	}
+	if msg.Type() == typeDiscMsg {
+		return &discRemoteError{reason: decodeDiscReason(data)}
+	}
+	if msg.Type() != typeProtoHandshake {
+		return fmt.Errorf("protocol handshake err, got message type: %d", msg.Type())
+	}
+	theirs := new(protoHandshakeMsg)
+	if !theirs.unmarshal(data) {
+		return errors.New("parse protocol handshake err")
+	}
+	if err = <-werr; err != nil {
+		return err
+	}
+	if len(c.server.protocols) > 0 && len(matchProtocols(c.server.protocols, theirs.caps)) == 0 {
+		c.logger.Debugf("protocol handshake err, no matching protocols in %v", theirs.caps)
+		c.disconnect(DiscUselessPeer)
+		return DiscUselessPeer
+	}
+	c.caps = theirs.caps
+	if c.flag&flagInbound != 0 {
+		c.codec = negotiateCodec(theirs.codecs, ours.codecs)
+	} else {
+		c.codec = negotiateCodec(ours.codecs, theirs.codecs)
+	}
+	c.compressMin = c.server.config.CompressThreshold
+	if c.compressMin == 0 {
+		c.compressMin = defaultCompressThreshold
+	}
+	return nil
+}
+
+// verifyHello checks that sign was made by the private key behind id.
+func verifyHello(id discover.NodeId, hash []byte, sign []byte) error {
+	pub, err := id.PubKey()
+	if err != nil {
+		return err
+	}
+	if !crypto.VerifySignatureByPublic(hash, sign, pub) {
+		return fmt.Errorf("handshake check err, invalid signature of node: 0x%x", id)
+	}
+	return nil
+}
+
+// secure derives the session keys from the ephemeral keys and nonces of
+// both sides and replaces rw with the encrypted channel.
+func (c *peerConn) secure(ephemeral *ecdsa.PrivateKey, remote discover.NodeId, initNonce, respNonce []byte, initiator bool) error {
+	remotePub, err := remote.PubKey()
+	if err != nil {
+		return err
+	}
+	shared, err := crypto.SharedSecret(ephemeral, remotePub)
+	if err != nil {
+		return err
+	}
+	s, err := deriveSecrets(shared, initNonce, respNonce, initiator)
+	if err != nil {
+		return err
+	}
+	rw, err := newSecureConn(c.rw, s)
+	if err != nil {
+		return err
+	}
+	c.rw = rw
 	return nil
 }
 
@@ -128,7 +313,7 @@ func (c *peerConn) readHelloReRequestMsg() (*helloReRequestMsg, error) {
 		return nil, err
 	}
 	if msg.Type() != typeReHelloRequest {
-		return nil, err
+		return nil, fmt.Errorf("handshake check err, got message type: %d", msg.Type())
 	}
 	nMsg := new(helloReRequestMsg)
 	raw, _ := ioutil.ReadAll(msg.RawReader())
@@ -145,7 +330,7 @@ func (c *peerConn) readHelloRequestMsg() (*helloRequestMsg, error) {
 		return nil, err
 	}
 	if msg.Type() != typeHelloRequest {
-		return nil, err
+		return nil, fmt.Errorf("handshake check err, got message type: %d", msg.Type())
 	}
 	nMsg := new(helloRequestMsg)
 	raw, _ := ioutil.ReadAll(msg.RawReader())
@@ -157,21 +342,102 @@ func (c *peerConn) readHelloRequestMsg() (*helloRequestMsg, error) {
 
 // Write peer session messages
 func (c *peerConn) writeMessage(mType uint8, data []byte) error {
-	cLen := len(data)
-	val := make([]byte, cLen+4)
-	binary.LittleEndian.PutUint32(val, uint32(cLen))
-	copy(val[4:], data)
-	msg := []byte{c.version, mType}
-	msg = append(msg, val...)
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := c.write(mType, data)
+	return err
+}
+
+// writeMessageDeadline writes a message which must be sent before deadline
+// and returns its size on the wire, nothing is written once closed is closed.
+func (c *peerConn) writeMessageDeadline(mType uint8, data []byte, deadline time.Time, closed chan struct{}) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	select {
+	case <-closed:
+		return 0, errPeerClosed
+	default:
+	}
+	_ = c.rw.SetWriteDeadline(deadline)
+	n, err := c.write(mType, data)
+	_ = c.rw.SetWriteDeadline(time.Time{})
+	return n, err
+}
+
+// write sends a message and returns its size on the wire.
+func (c *peerConn) write(mType uint8, data []byte) (int, error) {
+	version := c.version
+	if c.codec != nil && mType >= baseProtocolLength && uint64(len(data)) >= uint64(c.compressMin) {
+		// incompressible data is sent as it is
+		if z := c.codec.Compress(data); len(z) < len(data) {
+			version, data = version|flagCompressed, z
+		}
+	}
+	msg := make([]byte, headerLen, headerLen+len(data))
+	msg[0], msg[1] = version, mType
+	binary.LittleEndian.PutUint32(msg[2:], uint32(len(data)))
+	msg = append(msg, data...)
 	_, err := c.rw.Write(msg)
 	if err != nil {
-		return err
+		return 0, err
 	}
-	return nil
+	return len(msg), nil
 }
 
+// readMessage reads a message of the base protocol, it is used
+// during the handshakes.
 func (c *peerConn) readMessage() (MessageReader, error) {
-	return ReadMessage(c.rw)
+	return readMessage(c.rw, func(uint8) uint32 {
+		return baseMaxMsgSize
+	})
+}
+
+// decompress replaces the data of a compressed message by its
+// decompressed form, which must not exceed max bytes.
+func (c *peerConn) decompress(msg *messageReader, max uint32) error {
+	if msg.version&flagCompressed == 0 {
+		return nil
+	}
+	if c.codec == nil {
+		return fmt.Errorf("%w: no codec negotiated", errBadCompression)
+	}
+	data, err := c.codec.Decompress(msg.payload, max)
+	if err != nil {
+		if errors.Is(err, errMsgTooLarge) || errors.Is(err, errBadCompression) {
+			return err
+		}
+		return fmt.Errorf("%w: %v", errBadCompression, err)
+	}
+	if uint64(len(data)) > uint64(max) {
+		return fmt.Errorf("%w: type %d, decompressed size %d, limit %d", errMsgTooLarge, msg.mType, len(data), max)
+	}
+	header := make([]byte, headerLen)
+	header[0], header[1] = msg.version&^flagCompressed, msg.mType
+	binary.LittleEndian.PutUint32(header[2:], uint32(len(data)))
+	msg.version = header[0]
+	msg.raw = io.MultiReader(bytes.NewReader(header), bytes.NewReader(data))
+	msg.data = bytes.NewReader(data)
+	msg.payload = data
+	return nil
+}
+
+// disconnect sends the reason of closing the connection to the remote side,
+// errors are ignored as the connection is about to be closed anyway.
+func (c *peerConn) disconnect(reason DiscReason) {
+	// cut short a pending write of the peer, it holds wmu
+	_ = c.rw.SetWriteDeadline(time.Now().Add(discWriteTimeout))
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_ = c.rw.SetWriteDeadline(time.Now().Add(discWriteTimeout))
+	_, _ = c.write(typeDiscMsg, []byte{uint8(reason)})
+}
+
+// remoteIP returns the IP of the remote side, or nil if it is unknown.
+func (c *peerConn) remoteIP() net.IP {
+	if c.rw == nil {
+		return nil
+	}
+	return addrIP(c.rw.RemoteAddr())
 }
 
 func (c *peerConn) close() {
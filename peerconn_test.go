@@ -0,0 +1,97 @@
+package p2p
+
+import (
+	"bytes"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/discover"
+	"github.com/xfs-network/xlibp2p/log"
+	"net"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *server {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &server{
+		config: Config{Key: key},
+		nodeId: discover.PubKey2NodeId(key.PublicKey),
+		logger: log.DefaultLogger(),
+	}
+}
+
+func runTestHandshake(client, server *peerConn) (clientErr, serverErr error) {
+	errc := make(chan error, 1)
+	go func() {
+		err := server.serverHandshake()
+		if err != nil {
+			server.close()
+		}
+		errc <- err
+	}()
+	clientErr = client.clientHandshake()
+	if clientErr != nil {
+		client.close()
+	}
+	serverErr = <-errc
+	return
+}
+
+func TestPeerConn_handshake(t *testing.T) {
+	srvA, srvB := newTestServer(t), newTestServer(t)
+	connA, connB := net.Pipe()
+	client := srvA.newPeerConn(connA, flagOutbound, &srvB.nodeId)
+	server := srvB.newPeerConn(connB, flagInbound, nil)
+	clientErr, serverErr := runTestHandshake(client, server)
+	if clientErr != nil {
+		t.Fatal(clientErr)
+	}
+	if serverErr != nil {
+		t.Fatal(serverErr)
+	}
+	if !bytes.Equal(server.id[:], srvA.nodeId[:]) {
+		t.Fatalf("got remote id: %s, want: %s", server.id, srvA.nodeId)
+	}
+	want := []byte("hello secure world")
+	go func() {
+		_ = client.writeMessage(typePingMsg, want)
+	}()
+	msg, err := server.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := msg.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type() != typePingMsg || !bytes.Equal(got, want) {
+		t.Fatalf("got message type: %d, data: %s, want type: %d, data: %s",
+			msg.Type(), got, typePingMsg, want)
+	}
+}
+
+func TestPeerConn_handshakeImpersonation(t *testing.T) {
+	srvA, srvB, victim := newTestServer(t), newTestServer(t), newTestServer(t)
+	connA, connB := net.Pipe()
+	client := srvA.newPeerConn(connA, flagOutbound, &srvB.nodeId)
+	// claim the identity of another node without owning its key
+	client.self = victim.nodeId
+	server := srvB.newPeerConn(connB, flagInbound, nil)
+	_, serverErr := runTestHandshake(client, server)
+	if serverErr == nil {
+		t.Fatal("handshake with forged node id should fail")
+	}
+}
+
+func TestPeerConn_handshakeWrongRemote(t *testing.T) {
+	srvA, srvB, other := newTestServer(t), newTestServer(t), newTestServer(t)
+	connA, connB := net.Pipe()
+	// dial srvB expecting to reach another node
+	client := srvA.newPeerConn(connA, flagOutbound, &other.nodeId)
+	server := srvB.newPeerConn(connB, flagInbound, nil)
+	clientErr, _ := runTestHandshake(client, server)
+	if clientErr == nil {
+		t.Fatal("handshake with unexpected remote node should fail")
+	}
+}
@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"github.com/xfs-network/xlibp2p/discover"
+	"net"
+	"sort"
+	"time"
+)
+
+// PeerInfo is a snapshot of a connected peer, it is meant to be shown
+// in dashboards and can be encoded as JSON. Durations are encoded in
+// nanoseconds.
+type PeerInfo struct {
+	ID string `json:"id"`
+	// Node is the URL of the peer built from the remote address, the
+	// port of inbound peers is the source port of their connection.
+	Node       string `json:"node"`
+	RemoteAddr string `json:"remoteAddr"`
+	LocalAddr  string `json:"localAddr"`
+	// Direction is "inbound" or "outbound", outbound peers are either
+	// static or dynamic ones found by discovery.
+	Direction      string        `json:"direction"`
+	Inbound        bool          `json:"inbound"`
+	Static         bool          `json:"static"`
+	Dynamic        bool          `json:"dynamic"`
+	ConnectedSince time.Time     `json:"connectedSince"`
+	RTT            time.Duration `json:"rtt"`
+	Jitter         time.Duration `json:"jitter"`
+	// BytesIn and BytesOut count the bytes on the wire.
+	BytesIn   uint64 `json:"bytesIn"`
+	BytesOut  uint64 `json:"bytesOut"`
+	Protocols []Cap  `json:"protocols"`
+}
+
+func (p *peer) info() *PeerInfo {
+	info := &PeerInfo{
+		ID:             p.id.String(),
+		Direction:      p.conn.direction(),
+		Inbound:        p.Is(flagInbound),
+		Static:         p.Is(flagStatic),
+		Dynamic:        p.Is(flagDynamic),
+		ConnectedSince: p.created,
+		BytesIn:        p.traffic.ingress.Total(),
+		BytesOut:       p.traffic.egress.Total(),
+		Protocols:      make([]Cap, 0, len(p.ps)),
+	}
+	info.RTT, info.Jitter = p.RTT()
+	if p.rw != nil {
+		info.RemoteAddr = p.rw.RemoteAddr().String()
+		info.LocalAddr = p.rw.LocalAddr().String()
+		if addr, ok := p.rw.RemoteAddr().(*net.TCPAddr); ok {
+			info.Node = discover.NewNode(addr.IP, uint16(addr.Port), 0, p.id).String()
+		}
+	}
+	for _, rw := range p.ps {
+		info.Protocols = append(info.Protocols, Cap{Name: rw.proto.Name(), Version: rw.proto.Version()})
+	}
+	return info
+}
+
+// PeersInfo returns a snapshot of the connected peers sorted by id.
+func (srv *server) PeersInfo() []*PeerInfo {
+	srv.peersMu.RLock()
+	infos := make([]*PeerInfo, 0, len(srv.peers))
+	for _, p := range srv.peers {
+		if p, ok := p.(*peer); ok {
+			infos = append(infos, p.info())
+		}
+	}
+	srv.peersMu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Peer returns a snapshot of the peer, or nil if it is not connected.
+func (srv *server) Peer(id discover.NodeId) *PeerInfo {
+	srv.peersMu.RLock()
+	defer srv.peersMu.RUnlock()
+	if p, ok := srv.peers[id].(*peer); ok {
+		return p.info()
+	}
+	return nil
+}
@@ -1,5 +1,200 @@
 package p2p
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+// baseProtocolLength is the number of message types reserved for the
+// peer connection itself, protocol message types start after it.
+const baseProtocolLength = 16
+
+// protocolMsgQueueSize is the number of inbound messages buffered for each protocol.
+// A protocol which lets its queue overflow disconnects the peer with
+// DiscQueueOverflow.
+const protocolMsgQueueSize = 64
+
+var errInvalidMsgType = errors.New("invalid message type")
+
+// Protocol represents a sub-protocol run on top of the peer connection.
+// Protocols are identified by name and version, and are only started
+// on peers which announced the same name and version in the handshake.
 type Protocol interface {
-	Run(p Peer) error
+	// Name returns the name of the protocol, e.g. "chat".
+	Name() string
+	// Version returns the version of the protocol. If both sides support
+	// several versions of a protocol, the highest one is chosen.
+	Version() uint
+	// Length returns the number of message codes used by the protocol.
+	Length() uint8
+	// Run is called in its own goroutine when the protocol has been
+	// negotiated with the peer. The connection is closed if it returns an error.
+	Run(p ProtocolPeer) error
+}
+
+// MsgSizeLimiter may be implemented by a Protocol to set the maximum data
+// size of its messages, otherwise Config.MaxMessageSize applies. Larger
+// inbound messages disconnect the peer and larger writes fail.
+type MsgSizeLimiter interface {
+	MaxMsgSize() uint32
+}
+
+// Cap is the name and version of a protocol announced in the handshake.
+type Cap struct {
+	Name    string `json:"name"`
+	Version uint   `json:"version"`
+}
+
+func (c Cap) String() string {
+	return fmt.Sprintf("%s/%d", c.Name, c.Version)
+}
+
+func protocolCaps(ps []Protocol) []Cap {
+	caps := make([]Cap, 0, len(ps))
+	for _, item := range ps {
+		caps = append(caps, Cap{Name: item.Name(), Version: item.Version()})
+	}
+	return caps
+}
+
+// matchProtocols returns the protocols also supported by the remote side,
+// keeping only the highest shared version of each name. The result is
+// sorted by name so that both sides agree on the order.
+func matchProtocols(ps []Protocol, caps []Cap) []Protocol {
+	matched := make(map[string]Protocol)
+	for _, item := range ps {
+		for _, c := range caps {
+			if item.Name() != c.Name || item.Version() != c.Version {
+				continue
+			}
+			if old, exists := matched[c.Name]; !exists || old.Version() < c.Version {
+				matched[c.Name] = item
+			}
+		}
+	}
+	result := make([]Protocol, 0, len(matched))
+	for _, item := range matched {
+		result = append(result, item)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name() < result[j].Name()
+	})
+	return result
+}
+
+// protoRW is the view of a peer passed to a single protocol. Message types
+// are relative to the protocol, its offset is added on the wire, and
+// inbound messages are queued separately for each protocol.
+type protoRW struct {
+	*peer
+	proto    Protocol
+	offset   uint8
+	maxSize  uint32
+	in       chan MessageReader
+	// traffic is the bandwidth scope shared by all peers running the
+	// protocol, it is nil without a server.
+	traffic  *bandwidth
+	// counters are the traffic metrics of the message codes.
+	counters *trafficCounters
+}
+
+// newProtoRWs assigns consecutive message type ranges to the matched
+// protocols, protocols which do not fit into the message type space are
+// skipped on both sides.
+func newProtoRWs(p *peer, ps []Protocol) []*protoRW {
+	rws := make([]*protoRW, 0, len(ps))
+	offset := uint(baseProtocolLength)
+	defaultSize := uint32(defaultMaxMsgSize)
+	if p.conn.server != nil && p.conn.server.config.MaxMessageSize > 0 {
+		defaultSize = p.conn.server.config.MaxMessageSize
+	}
+	for _, item := range ps {
+		if offset+uint(item.Length()) > math.MaxUint8+1 {
+			p.logger.Warnf("skip protocol %s/%d, message types exhausted", item.Name(), item.Version())
+			continue
+		}
+		var traffic *bandwidth
+		if p.conn.server != nil {
+			traffic = p.conn.server.protocolTraffic(item.Name())
+		}
+		maxSize := defaultSize
+		if limiter, ok := item.(MsgSizeLimiter); ok {
+			maxSize = limiter.MaxMsgSize()
+		}
+		rws = append(rws, &protoRW{
+			peer:     p,
+			proto:    item,
+			offset:   uint8(offset),
+			maxSize:  maxSize,
+			in:       make(chan MessageReader, protocolMsgQueueSize),
+			traffic:  traffic,
+			counters: newTrafficCounters(p.metrics, item.Name(), item.Length()),
+		})
+		offset += uint(item.Length())
+	}
+	return rws
+}
+
+// GetProtocolMsgCh returns the inbound messages of this protocol.
+func (rw *protoRW) GetProtocolMsgCh() chan MessageReader {
+	return rw.in
+}
+
+// WriteMessage sends a message with a type relative to the protocol.
+func (rw *protoRW) WriteMessage(mType uint8, data []byte) error {
+	return rw.WriteMessageContext(context.Background(), mType, data)
+}
+
+func (rw *protoRW) WriteMessageContext(ctx context.Context, mType uint8, data []byte) error {
+	if err := rw.checkWrite(mType, data); err != nil {
+		return err
+	}
+	if err := rw.peer.WriteMessageContext(ctx, rw.offset+mType, data); err != nil {
+		return err
+	}
+	rw.emitSend(mType, data)
+	return nil
+}
+
+// TrySend queues a message with a type relative to the protocol without waiting.
+func (rw *protoRW) TrySend(mType uint8, data []byte) error {
+	if err := rw.checkWrite(mType, data); err != nil {
+		return err
+	}
+	if err := rw.peer.TrySend(rw.offset+mType, data); err != nil {
+		return err
+	}
+	rw.emitSend(mType, data)
+	return nil
+}
+
+func (rw *protoRW) checkWrite(mType uint8, data []byte) error {
+	if mType >= rw.proto.Length() {
+		return errInvalidMsgType
+	}
+	if uint64(len(data)) > uint64(rw.maxSize) {
+		return fmt.Errorf("%w: size %d, limit %d", errMsgTooLarge, len(data), rw.maxSize)
+	}
+	return nil
+}
+
+func (rw *protoRW) emitSend(mType uint8, data []byte) {
+	rw.emit(&PeerEvent{
+		Type:     PeerEventTypeMsgSend,
+		Peer:     rw.id,
+		Protocol: rw.proto.Name(),
+		MsgCode:  mType,
+		MsgSize:  uint32(len(data)),
+	})
+}
+
+func (rw *protoRW) WriteMessageObj(mType uint8, obj interface{}) error {
+	bs, err := rw.encoder.Encode(obj)
+	if err != nil {
+		return err
+	}
+	return rw.WriteMessage(mType, bs)
 }
@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"reflect"
+	"testing"
+)
+
+type testProtocol struct {
+	name    string
+	version uint
+	length  uint8
+	run     func(p ProtocolPeer) error
+}
+
+func (tp *testProtocol) Name() string {
+	return tp.name
+}
+
+func (tp *testProtocol) Version() uint {
+	return tp.version
+}
+
+func (tp *testProtocol) Length() uint8 {
+	return tp.length
+}
+
+func (tp *testProtocol) Run(p ProtocolPeer) error {
+	if tp.run == nil {
+		<-p.CloseCh()
+		return nil
+	}
+	return tp.run(p)
+}
+
+func TestMatchProtocols(t *testing.T) {
+	ours := []Protocol{
+		&testProtocol{name: "sync", version: 1, length: 2},
+		&testProtocol{name: "sync", version: 2, length: 3},
+		&testProtocol{name: "chat", version: 1, length: 1},
+		&testProtocol{name: "blocks", version: 1, length: 1},
+	}
+	theirs := []Cap{
+		{Name: "sync", Version: 1},
+		{Name: "sync", Version: 2},
+		{Name: "chat", Version: 1},
+		{Name: "tx", Version: 1},
+	}
+	got := protocolCaps(matchProtocols(ours, theirs))
+	want := []Cap{
+		{Name: "chat", Version: 1},
+		{Name: "sync", Version: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got matched protocols: %v, want: %v", got, want)
+	}
+	if got := matchProtocols(ours, []Cap{{Name: "sync", Version: 3}}); len(got) != 0 {
+		t.Fatalf("got matched protocols: %v, want none", protocolCaps(got))
+	}
+}
+
+func TestProtoHandshakeMsg(t *testing.T) {
+	msg := &protoHandshakeMsg{caps: []Cap{
+		{Name: "sync", Version: 2},
+		{Name: "chat", Version: 1},
+	}}
+	got := new(protoHandshakeMsg)
+	if !got.unmarshal(msg.marshal()) {
+		t.Fatal("parse protocol handshake err")
+	}
+	if !reflect.DeepEqual(got.caps, msg.caps) {
+		t.Fatalf("got caps: %v, want: %v", got.caps, msg.caps)
+	}
+	if got.unmarshal([]byte{1, 4, 's', 'y'}) {
+		t.Fatal("truncated protocol handshake should not parse")
+	}
+	msg.codecs = []string{"snappy", "zstd"}
+	if !got.unmarshal(msg.marshal()) {
+		t.Fatal("parse protocol handshake with codecs err")
+	}
+	if !reflect.DeepEqual(got.codecs, msg.codecs) {
+		t.Fatalf("got codecs: %v, want: %v", got.codecs, msg.codecs)
+	}
+	data := msg.marshal()
+	if got.unmarshal(data[:len(data)-1]) {
+		t.Fatal("truncated codecs should not parse")
+	}
+}
@@ -0,0 +1,145 @@
+package pubsub
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/xfs-network/xlibp2p/common"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/discover"
+	"time"
+)
+
+// message = ttl(1byte)+origin(64byte)+seq(8byte)+topicLen(1byte)+topic+data
+// seq is stored by LittleEndian model. The ttl is the number of further
+// hops, it is decremented by every relay and is not part of the id.
+const messageHeadSize = 1 + len(discover.NodeId{}) + 8 + 1
+
+var errShortMessage = errors.New("pubsub message too short")
+
+// Message is a message published on a topic.
+type Message struct {
+	Topic string
+	Data  []byte
+	// From is the node which published the message.
+	From discover.NodeId
+	// Seq is a sequence number chosen by the publisher.
+	Seq uint64
+	// ReceivedFrom is the peer which relayed the message to us.
+	ReceivedFrom discover.NodeId
+
+	ttl uint8
+	id  common.Hash
+}
+
+// ID returns the hash identifying the message in the network.
+func (m *Message) ID() common.Hash {
+	return m.id
+}
+
+func (m *Message) marshal() []byte {
+	buf := make([]byte, messageHeadSize, messageHeadSize+len(m.Topic)+len(m.Data))
+	buf[0] = m.ttl
+	copy(buf[1:], m.From[:])
+	binary.LittleEndian.PutUint64(buf[1+len(m.From):], m.Seq)
+	buf[messageHeadSize-1] = uint8(len(m.Topic))
+	buf = append(buf, m.Topic...)
+	buf = append(buf, m.Data...)
+	return buf
+}
+
+func (m *Message) unmarshal(data []byte) error {
+	if len(data) < messageHeadSize {
+		return errShortMessage
+	}
+	topicLen := int(data[messageHeadSize-1])
+	if len(data) < messageHeadSize+topicLen {
+		return errShortMessage
+	}
+	m.ttl = data[0]
+	copy(m.From[:], data[1:])
+	m.Seq = binary.LittleEndian.Uint64(data[1+len(m.From):])
+	m.Topic = string(data[messageHeadSize : messageHeadSize+topicLen])
+	m.Data = data[messageHeadSize+topicLen:]
+	m.id = messageID(data[1:])
+	return nil
+}
+
+// messageID hashes everything but the ttl of an encoded message.
+func messageID(body []byte) common.Hash {
+	return crypto.ByteHash256(body)
+}
+
+// seenCache remembers message ids for a while so that messages which
+// arrive over several paths are handled only once. It is not safe for
+// concurrent use.
+type seenCache struct {
+	ttl     time.Duration
+	max     int
+	entries map[common.Hash]struct{}
+	// order is a ring of the entries from the oldest to the newest, it
+	// starts at head and grows up to max entries.
+	order []seenEntry
+	head  int
+	count int
+}
+
+type seenEntry struct {
+	id   common.Hash
+	time time.Time
+}
+
+func newSeenCache(ttl time.Duration, max int) *seenCache {
+	if max < 1 {
+		max = 1
+	}
+	return &seenCache{ttl: ttl, max: max, entries: make(map[common.Hash]struct{})}
+}
+
+// add adds id to the cache and reports whether it was new.
+func (c *seenCache) add(id common.Hash, now time.Time) bool {
+	c.expire(now)
+	if _, exists := c.entries[id]; exists {
+		return false
+	}
+	if c.count == c.max {
+		c.pop()
+	}
+	if c.count == len(c.order) {
+		c.grow()
+	}
+	c.order[(c.head+c.count)%len(c.order)] = seenEntry{id, now}
+	c.count++
+	c.entries[id] = struct{}{}
+	return true
+}
+
+// expire drops the oldest entries which are expired.
+func (c *seenCache) expire(now time.Time) {
+	for c.count > 0 && now.Sub(c.order[c.head].time) > c.ttl {
+		c.pop()
+	}
+}
+
+// pop drops the oldest entry.
+func (c *seenCache) pop() {
+	delete(c.entries, c.order[c.head].id)
+	c.order[c.head] = seenEntry{}
+	c.head = (c.head + 1) % len(c.order)
+	c.count--
+}
+
+// grow doubles the ring up to max entries, it is only called when the
+// ring is full.
+func (c *seenCache) grow() {
+	size := 2 * len(c.order)
+	if size == 0 {
+		size = 64
+	}
+	if size > c.max {
+		size = c.max
+	}
+	order := make([]seenEntry, size)
+	n := copy(order, c.order[c.head:])
+	copy(order[n:], c.order[:c.head])
+	c.order, c.head = order, 0
+}
@@ -0,0 +1,320 @@
+// Package pubsub implements a publish/subscribe protocol which broadcasts
+// messages on named topics across the network.
+//
+// Messages are flooded: every node relays a new message to all of its
+// peers except the one it came from, until its hop limit is used up.
+// Each node remembers the ids of recent messages and drops the copies
+// which arrive over other paths.
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	p2p "github.com/xfs-network/xlibp2p"
+	"github.com/xfs-network/xlibp2p/discover"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ProtocolName    = "pubsub"
+	ProtocolVersion = 1
+	protocolLength  = 1
+
+	msgCode uint8 = 0
+)
+
+const (
+	defaultMaxHops       = 8
+	defaultSeenTTL       = 2 * time.Minute
+	defaultSeenSize      = 1 << 16
+	defaultSubBufferSize = 64
+	// peerQueueSize is the number of outbound messages buffered for each
+	// peer, messages to slow peers are dropped when it is full.
+	peerQueueSize = 128
+	// scoreRejected is reported for peers sending messages which
+	// the validator of the topic rejected.
+	scoreRejected float64 = -5
+)
+
+var (
+	errInvalidTopic = errors.New("invalid topic")
+	errRejected     = errors.New("message rejected by validator")
+)
+
+// Validator decides whether a message on a topic is delivered and relayed.
+// It is called from the protocol loop of the peer which sent the message,
+// so it should return quickly.
+type Validator func(msg *Message) bool
+
+// Config sets the parameters of the protocol, zero values use defaults.
+type Config struct {
+	// MaxHops is the number of times a published message is relayed.
+	MaxHops uint8
+	// SeenTTL is how long message ids are remembered.
+	SeenTTL time.Duration
+	// SeenSize is the maximum number of remembered message ids.
+	SeenSize int
+	// SubBufferSize is the buffer of subscription channels, messages are
+	// dropped for subscribers which do not keep up.
+	SubBufferSize int
+}
+
+// PubSub is the pubsub protocol, bind it to the server with Server.Bind.
+type PubSub struct {
+	self   discover.NodeId
+	config Config
+	seq    uint64 // accessed atomically
+
+	mu         sync.Mutex
+	seen       *seenCache
+	peers      map[discover.NodeId]chan []byte
+	subs       map[string]map[*Subscription]struct{}
+	validators map[string]Validator
+}
+
+// New creates the protocol for the node with the given id.
+func New(self discover.NodeId, config Config) *PubSub {
+	if config.MaxHops == 0 {
+		config.MaxHops = defaultMaxHops
+	}
+	if config.SeenTTL == 0 {
+		config.SeenTTL = defaultSeenTTL
+	}
+	if config.SeenSize == 0 {
+		config.SeenSize = defaultSeenSize
+	}
+	if config.SubBufferSize == 0 {
+		config.SubBufferSize = defaultSubBufferSize
+	}
+	return &PubSub{
+		self:       self,
+		config:     config,
+		seen:       newSeenCache(config.SeenTTL, config.SeenSize),
+		peers:      make(map[discover.NodeId]chan []byte),
+		subs:       make(map[string]map[*Subscription]struct{}),
+		validators: make(map[string]Validator),
+	}
+}
+
+func (ps *PubSub) Name() string {
+	return ProtocolName
+}
+
+func (ps *PubSub) Version() uint {
+	return ProtocolVersion
+}
+
+func (ps *PubSub) Length() uint8 {
+	return protocolLength
+}
+
+// Run relays messages from and to the peer until it is closed.
+func (ps *PubSub) Run(p p2p.ProtocolPeer) error {
+	out := make(chan []byte, peerQueueSize)
+	ps.mu.Lock()
+	ps.peers[p.ID()] = out
+	ps.mu.Unlock()
+	defer func() {
+		ps.mu.Lock()
+		if ps.peers[p.ID()] == out {
+			delete(ps.peers, p.ID())
+		}
+		ps.mu.Unlock()
+	}()
+	werr := make(chan error, 1)
+	go func() {
+		werr <- ps.writeLoop(p, out)
+	}()
+	for {
+		select {
+		case msg := <-p.GetProtocolMsgCh():
+			if msg.Type() != msgCode {
+				return fmt.Errorf("pubsub got message code: %d", msg.Type())
+			}
+			data, err := msg.ReadAll()
+			if err != nil {
+				return err
+			}
+			err = ps.handle(p.ID(), data)
+			if err == errRejected {
+				p.Report(scoreRejected, err.Error())
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		case err := <-werr:
+			return err
+		case <-p.CloseCh():
+			return nil
+		}
+	}
+}
+
+func (ps *PubSub) writeLoop(p p2p.Peer, out chan []byte) error {
+	for {
+		select {
+		case data := <-out:
+			if err := p.WriteMessage(msgCode, data); err != nil {
+				return err
+			}
+		case <-p.CloseCh():
+			return nil
+		}
+	}
+}
+
+// Peers returns the ids of the peers running the protocol.
+func (ps *PubSub) Peers() []discover.NodeId {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ids := make([]discover.NodeId, 0, len(ps.peers))
+	for id := range ps.peers {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Subscribe returns a subscription to the messages of a topic.
+func (ps *PubSub) Subscribe(topic string) (*Subscription, error) {
+	if err := validTopic(topic); err != nil {
+		return nil, err
+	}
+	sub := &Subscription{
+		ps:    ps,
+		topic: topic,
+		ch:    make(chan *Message, ps.config.SubBufferSize),
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.subs[topic] == nil {
+		ps.subs[topic] = make(map[*Subscription]struct{})
+	}
+	ps.subs[topic][sub] = struct{}{}
+	return sub, nil
+}
+
+// SetValidator sets the validator of a topic, nil removes it.
+func (ps *PubSub) SetValidator(topic string, v Validator) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if v == nil {
+		delete(ps.validators, topic)
+		return
+	}
+	ps.validators[topic] = v
+}
+
+// Publish sends data to all nodes subscribed to the topic, it is not
+// delivered to the local subscribers.
+func (ps *PubSub) Publish(topic string, data []byte) error {
+	if err := validTopic(topic); err != nil {
+		return err
+	}
+	msg := &Message{
+		Topic: topic,
+		Data:  data,
+		From:  ps.self,
+		Seq:   atomic.AddUint64(&ps.seq, 1),
+		ttl:   ps.config.MaxHops,
+	}
+	raw := msg.marshal()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.seen.add(messageID(raw[1:]), time.Now())
+	ps.broadcast(raw, discover.NodeId{})
+	return nil
+}
+
+// handle delivers and relays a message received from a peer.
+func (ps *PubSub) handle(from discover.NodeId, data []byte) error {
+	msg := new(Message)
+	if err := msg.unmarshal(data); err != nil {
+		return err
+	}
+	msg.ReceivedFrom = from
+	ps.mu.Lock()
+	fresh := msg.From != ps.self && ps.seen.add(msg.id, time.Now())
+	v := ps.validators[msg.Topic]
+	ps.mu.Unlock()
+	if !fresh {
+		return nil
+	}
+	// invalid messages stay in the seen cache, so their copies are dropped too
+	if v != nil && !v(msg) {
+		return errRejected
+	}
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for sub := range ps.subs[msg.Topic] {
+		select {
+		case sub.ch <- msg:
+		default:
+		}
+	}
+	// the hops left are bounded by our own limit, so a remote can not
+	// make the message travel further
+	ttl := msg.ttl
+	if ttl > ps.config.MaxHops {
+		ttl = ps.config.MaxHops
+	}
+	if ttl > 0 {
+		relay := append([]byte{ttl - 1}, data[1:]...)
+		ps.broadcast(relay, from)
+	}
+	return nil
+}
+
+// broadcast queues data for every peer but except, the caller must hold mu.
+func (ps *PubSub) broadcast(data []byte, except discover.NodeId) {
+	for id, out := range ps.peers {
+		if id == except {
+			continue
+		}
+		select {
+		case out <- data:
+		default:
+		}
+	}
+}
+
+func validTopic(topic string) error {
+	if topic == "" || len(topic) > math.MaxUint8 {
+		return errInvalidTopic
+	}
+	return nil
+}
+
+// Subscription receives the messages of a topic.
+type Subscription struct {
+	ps    *PubSub
+	topic string
+	ch    chan *Message
+	once  sync.Once
+}
+
+// Topic returns the topic of the subscription.
+func (s *Subscription) Topic() string {
+	return s.topic
+}
+
+// Messages returns the channel of received messages, it is closed by Cancel.
+func (s *Subscription) Messages() <-chan *Message {
+	return s.ch
+}
+
+// Cancel stops the subscription, it is safe to call it more than once.
+func (s *Subscription) Cancel() {
+	s.once.Do(func() {
+		s.ps.mu.Lock()
+		defer s.ps.mu.Unlock()
+		delete(s.ps.subs[s.topic], s)
+		if len(s.ps.subs[s.topic]) == 0 {
+			delete(s.ps.subs, s.topic)
+		}
+		close(s.ch)
+	})
+}
@@ -0,0 +1,178 @@
+package pubsub
+
+import (
+	p2p "github.com/xfs-network/xlibp2p"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/discover"
+	"testing"
+	"time"
+)
+
+func startTestNode(t *testing.T, static ...*discover.Node) (p2p.Server, *PubSub) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := p2p.NewServer(p2p.Config{
+		Key:         key,
+		ListenAddr:  "127.0.0.1:0",
+		MaxPeers:    10,
+		StaticNodes: static,
+	})
+	ps := New(srv.NodeId(), Config{})
+	if err = srv.Bind(ps); err != nil {
+		t.Fatal(err)
+	}
+	if err = srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return srv, ps
+}
+
+func waitPeers(t *testing.T, ps *PubSub, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ps.Peers()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("got peers: %d, want: %d", len(ps.Peers()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPubSub_relay(t *testing.T) {
+	// a - b - c, messages of a reach c through b
+	srvA, psA := startTestNode(t)
+	defer srvA.Stop()
+	srvB, psB := startTestNode(t, srvA.Node())
+	defer srvB.Stop()
+	srvC, psC := startTestNode(t, srvB.Node())
+	defer srvC.Stop()
+	waitPeers(t, psB, 2)
+	waitPeers(t, psC, 1)
+
+	subB, err := psB.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subB.Cancel()
+	subC, err := psC.Subscribe("news")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subC.Cancel()
+	psB.SetValidator("news", func(msg *Message) bool {
+		return string(msg.Data) != "spam"
+	})
+	if err = psA.Publish("news", []byte("spam")); err != nil {
+		t.Fatal(err)
+	}
+	if err = psA.Publish("news", []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []*Subscription{subB, subC} {
+		select {
+		case msg := <-sub.Messages():
+			if string(msg.Data) != "hello" || msg.From != srvA.NodeId() {
+				t.Fatalf("got message: %s from %s", msg.Data, msg.From)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not delivered")
+		}
+	}
+	select {
+	case msg := <-subC.Messages():
+		t.Fatalf("got unexpected message: %s", msg.Data)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPubSub_dedupAndHops(t *testing.T) {
+	ps := New(discover.NodeId{1}, Config{})
+	out := make(chan []byte, 4)
+	ps.peers[discover.NodeId{3}] = out
+	sub, err := ps.Subscribe("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := &Message{Topic: "t", Data: []byte("x"), From: discover.NodeId{2}, Seq: 1, ttl: 1}
+	raw := msg.marshal()
+	for i := 0; i < 2; i++ {
+		if err = ps.handle(discover.NodeId{2}, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(sub.Messages()) != 1 {
+		t.Fatalf("got delivered: %d, want: 1", len(sub.Messages()))
+	}
+	relayed := <-out
+	if len(out) != 0 || relayed[0] != 0 {
+		t.Fatalf("got relayed: %d, ttl: %d, want one with ttl 0", len(out)+1, relayed[0])
+	}
+	// a message without hops left is delivered but not relayed
+	if err = ps.handle(discover.NodeId{3}, relayed); err != nil {
+		t.Fatal(err)
+	}
+	msg.Seq = 2
+	msg.ttl = 0
+	if err = ps.handle(discover.NodeId{2}, msg.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if len(sub.Messages()) != 2 || len(out) != 0 {
+		t.Fatalf("got delivered: %d, relayed: %d, want: 2, 0", len(sub.Messages()), len(out))
+	}
+}
+
+func TestSeenCache_expire(t *testing.T) {
+	c := newSeenCache(time.Minute, 2)
+	now := time.Now()
+	ids := [3][32]byte{{1}, {2}, {3}}
+	for _, id := range ids {
+		if !c.add(id, now) {
+			t.Fatal("new id reported as seen")
+		}
+	}
+	// the oldest entry was dropped by the size limit
+	if !c.add(ids[0], now) || c.add(ids[2], now) {
+		t.Fatal("unexpected seen state after size limit")
+	}
+	if !c.add(ids[2], now.Add(2*time.Minute)) {
+		t.Fatal("expired id reported as seen")
+	}
+}
+
+func TestSeenCache_ring(t *testing.T) {
+	c := newSeenCache(time.Minute, 100)
+	now := time.Now()
+	id := func(i int) [32]byte { return [32]byte{byte(i), byte(i >> 8)} }
+	// the ring wraps around several times while growing and when full
+	for i := 0; i < 1000; i++ {
+		if !c.add(id(i), now) {
+			t.Fatalf("new id %d reported as seen", i)
+		}
+	}
+	if c.count != 100 || len(c.entries) != 100 || len(c.order) != 100 {
+		t.Fatalf("got count: %d, entries: %d, ring: %d, want 100", c.count, len(c.entries), len(c.order))
+	}
+	for i := 900; i < 1000; i++ {
+		if c.add(id(i), now) {
+			t.Fatalf("recent id %d reported as new", i)
+		}
+	}
+	if !c.add(id(899), now) {
+		t.Fatal("dropped id reported as seen")
+	}
+}
+
+func TestPubSub_maxHops(t *testing.T) {
+	ps := New(discover.NodeId{1}, Config{MaxHops: 2})
+	out := make(chan []byte, 1)
+	ps.peers[discover.NodeId{3}] = out
+	msg := &Message{Topic: "t", Data: []byte("x"), From: discover.NodeId{2}, Seq: 1, ttl: 255}
+	if err := ps.handle(discover.NodeId{2}, msg.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	// the ttl of the wire is clamped to our own limit before relaying
+	if relayed := <-out; relayed[0] != 1 {
+		t.Fatalf("got relayed ttl: %d, want: 1", relayed[0])
+	}
+}
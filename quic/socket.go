@@ -0,0 +1,222 @@
+package quic
+
+import (
+	quicgo "github.com/quic-go/quic-go"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxPacketSize is the largest UDP payload.
+	maxPacketSize = 65535
+	// quicQueueSize and packetQueueSize are the numbers of received
+	// packets buffered for QUIC and the discovery, further packets are
+	// dropped like by a full socket buffer.
+	quicQueueSize   = 1024
+	packetQueueSize = 256
+)
+
+type packet struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// socket is a UDP socket shared by QUIC and the discovery. A single
+// reader sorts the received packets with match, quic-go reads its packets
+// through demuxConn.
+type socket struct {
+	conn    *net.UDPConn
+	qt      *quicgo.Transport
+	match   func([]byte) bool
+	quic    chan packet
+	packets chan packet
+	// refs counts the users of the socket, it is guarded by Transport.mu.
+	refs      int
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newSocket(conn *net.UDPConn, match func([]byte) bool) *socket {
+	s := &socket{
+		conn:    conn,
+		match:   match,
+		quic:    make(chan packet, quicQueueSize),
+		packets: make(chan packet, packetQueueSize),
+		closed:  make(chan struct{}),
+	}
+	s.qt = &quicgo.Transport{Conn: &demuxConn{s: s, wake: make(chan struct{}, 1)}}
+	go s.readLoop()
+	return s
+}
+
+func (s *socket) addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+func (s *socket) readLoop() {
+	defer s.shutdown()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			return
+		}
+		p := packet{data: append([]byte(nil), buf[:n]...), addr: addr}
+		queue := s.quic
+		if s.match != nil && s.match(p.data) {
+			queue = s.packets
+		}
+		select {
+		case queue <- p:
+		default:
+		}
+	}
+}
+
+// close stops QUIC and closes the UDP socket.
+func (s *socket) close() {
+	_ = s.qt.Close()
+	s.shutdown()
+	_ = s.conn.Close()
+}
+
+func (s *socket) shutdown() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// demuxConn is the net.PacketConn of quic-go, it reads the packets which
+// are not for the discovery. The methods besides reading and writing let
+// quic-go tune the UDP socket.
+type demuxConn struct {
+	s        *socket
+	mu       sync.Mutex
+	deadline time.Time
+	// wake interrupts a read when the deadline changes.
+	wake chan struct{}
+}
+
+func (c *demuxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		if n, addr, done, err := c.read(b); done {
+			return n, addr, err
+		}
+	}
+}
+
+// read waits for a packet until the deadline, it is not done if the
+// deadline was changed meanwhile.
+func (c *demuxConn) read(b []byte) (n int, addr net.Addr, done bool, err error) {
+	c.mu.Lock()
+	deadline := c.deadline
+	c.mu.Unlock()
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, true, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case p := <-c.s.quic:
+		return copy(b, p.data), p.addr, true, nil
+	case <-c.s.closed:
+		return 0, nil, true, net.ErrClosed
+	case <-c.wake:
+	case <-expired:
+	}
+	return 0, nil, false, nil
+}
+
+func (c *demuxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.s.conn.WriteTo(b, addr)
+}
+
+// Close does not close the socket, it outlives quic-go.
+func (c *demuxConn) Close() error {
+	return nil
+}
+
+func (c *demuxConn) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
+
+func (c *demuxConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *demuxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadline = t
+	c.mu.Unlock()
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (c *demuxConn) SetWriteDeadline(t time.Time) error {
+	return c.s.conn.SetWriteDeadline(t)
+}
+
+func (c *demuxConn) SetReadBuffer(bytes int) error {
+	return c.s.conn.SetReadBuffer(bytes)
+}
+
+func (c *demuxConn) SetWriteBuffer(bytes int) error {
+	return c.s.conn.SetWriteBuffer(bytes)
+}
+
+func (c *demuxConn) SyscallConn() (syscall.RawConn, error) {
+	return c.s.conn.SyscallConn()
+}
+
+// packetConn is the discovery side of a shared socket, it implements
+// p2p.PacketConn.
+type packetConn struct {
+	t         *Transport
+	s         *socket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *packetConn) ReadFromUDP(b []byte) (int, *net.UDPAddr, error) {
+	select {
+	case p := <-c.s.packets:
+		return copy(b, p.data), p.addr, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	case <-c.s.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *packetConn) WriteToUDP(b []byte, addr *net.UDPAddr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.s.conn.WriteToUDP(b, addr)
+}
+
+func (c *packetConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.t.release(c.s)
+	})
+	return nil
+}
+
+func (c *packetConn) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
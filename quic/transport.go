@@ -0,0 +1,364 @@
+// Package quic carries peer connections over QUIC. It implements
+// p2p.PacketTransport, so the node discovery shares the UDP socket of the
+// transport and a node listens on a single UDP port for both.
+//
+// Each peer connection is one bidirectional stream of a QUIC connection.
+// TLS only sets up the QUIC encryption, the certificates are self-signed
+// and not verified. Peers authenticate with their node keys in the p2p
+// handshake which runs on top of the stream.
+package quic
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	quicgo "github.com/quic-go/quic-go"
+	p2p "github.com/xfs-network/xlibp2p"
+	"math/big"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// alpn is the application protocol negotiated in the TLS handshake.
+	alpn = "xlibp2p"
+	// streamTimeout bounds the wait for the stream of an accepted connection.
+	streamTimeout = 10 * time.Second
+	// lingerTimeout bounds the time a closed connection waits for the
+	// remote side to receive the last written data.
+	lingerTimeout = time.Second
+)
+
+var errShared = errors.New("quic: socket already shared with the discovery")
+
+var _ p2p.PacketTransport = (*Transport)(nil)
+
+// Transport dials and listens on QUIC, create it with NewTransport. All
+// connections of a local port share one UDP socket, it is closed when the
+// last listener, discovery conn and connection on it are closed.
+type Transport struct {
+	// Config tunes the QUIC connections, nil uses the defaults of quic-go.
+	Config *quicgo.Config
+
+	serverTLS *tls.Config
+	clientTLS *tls.Config
+	mu        sync.Mutex
+	sockets   map[int]*socket
+}
+
+// NewTransport creates a transport with a new self-signed certificate.
+func NewTransport() (*Transport, error) {
+	cert, err := selfSignedCert()
+	if err != nil {
+		return nil, err
+	}
+	return &Transport{
+		serverTLS: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{alpn},
+			MinVersion:   tls.VersionTLS13,
+		},
+		clientTLS: &tls.Config{
+			// the p2p handshake authenticates the peer
+			InsecureSkipVerify: true,
+			NextProtos:         []string{alpn},
+			MinVersion:         tls.VersionTLS13,
+		},
+		sockets: make(map[int]*socket),
+	}, nil
+}
+
+// Listen accepts QUIC connections on the UDP address. A socket opened by
+// ListenPacket on the same port is shared.
+func (t *Transport) Listen(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	s := t.lookup(laddr)
+	if s == nil {
+		if s, err = t.open(laddr, nil); err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+	}
+	s.refs++
+	t.mu.Unlock()
+	ln, err := s.qt.Listen(t.serverTLS, t.Config)
+	if err != nil {
+		t.release(s)
+		return nil, err
+	}
+	l := &listener{
+		t:      t,
+		s:      s,
+		ln:     ln,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+	go l.loop()
+	return l, nil
+}
+
+// ListenPacket opens the UDP socket of the address for the discovery,
+// the packets for which match returns true are read from the returned
+// conn.
+func (t *Transport) ListenPacket(addr string, match func(packet []byte) bool) (p2p.PacketConn, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.lookup(laddr) != nil {
+		return nil, errShared
+	}
+	s, err := t.open(laddr, match)
+	if err != nil {
+		return nil, err
+	}
+	s.refs++
+	return &packetConn{t: t, s: s, closed: make(chan struct{})}, nil
+}
+
+// Dial connects to the UDP address. The connection is made from a socket
+// which can reach the address, so it comes from the listening port if
+// possible.
+func (t *Transport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	s := t.reaching(raddr)
+	if s == nil {
+		if s, err = t.open(&net.UDPAddr{}, nil); err != nil {
+			t.mu.Unlock()
+			return nil, err
+		}
+	}
+	s.refs++
+	t.mu.Unlock()
+	qc, err := s.qt.Dial(ctx, raddr, t.clientTLS, t.Config)
+	if err != nil {
+		t.release(s)
+		return nil, err
+	}
+	st, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		_ = qc.CloseWithError(0, "no stream")
+		t.release(s)
+		return nil, err
+	}
+	return t.newConn(s, qc, st), nil
+}
+
+// lookup returns the open socket of the address, the caller must hold mu.
+func (t *Transport) lookup(laddr *net.UDPAddr) *socket {
+	if laddr.Port == 0 {
+		return nil
+	}
+	s := t.sockets[laddr.Port]
+	if s == nil || !sameIP(s.addr().IP, laddr.IP) {
+		return nil
+	}
+	return s
+}
+
+// reaching returns an open socket which can send to the address, the
+// caller must hold mu.
+func (t *Transport) reaching(raddr *net.UDPAddr) *socket {
+	for _, s := range t.sockets {
+		ip := s.addr().IP
+		if ip == nil || ip.IsUnspecified() {
+			return s
+		}
+		if (ip.To4() == nil) == (raddr.IP.To4() == nil) && ip.IsLoopback() == raddr.IP.IsLoopback() {
+			return s
+		}
+	}
+	return nil
+}
+
+// open opens a socket without references, the caller must hold mu.
+func (t *Transport) open(laddr *net.UDPAddr, match func([]byte) bool) (*socket, error) {
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	s := newSocket(conn, match)
+	t.sockets[s.addr().Port] = s
+	return s, nil
+}
+
+func (t *Transport) ref(s *socket) {
+	t.mu.Lock()
+	s.refs++
+	t.mu.Unlock()
+}
+
+// release drops a reference of the socket and closes it with the last one.
+func (t *Transport) release(s *socket) {
+	t.mu.Lock()
+	s.refs--
+	last := s.refs == 0
+	if last {
+		delete(t.sockets, s.addr().Port)
+	}
+	t.mu.Unlock()
+	if last {
+		s.close()
+	}
+}
+
+func (t *Transport) newConn(s *socket, qc *quicgo.Conn, st *quicgo.Stream) *conn {
+	c := &conn{Stream: st, qc: qc}
+	// the socket is kept until the connection is gone, like the TCP
+	// connections of a closed listener
+	go func() {
+		<-qc.Context().Done()
+		t.release(s)
+	}()
+	return c
+}
+
+func sameIP(a, b net.IP) bool {
+	if a == nil || a.IsUnspecified() {
+		return b == nil || b.IsUnspecified()
+	}
+	return a.Equal(b)
+}
+
+// tcpAddr reports a UDP address as *net.TCPAddr, which p2p.Transport
+// requires for the addresses of listeners and connections.
+func tcpAddr(addr net.Addr) *net.TCPAddr {
+	if u, ok := addr.(*net.UDPAddr); ok {
+		return &net.TCPAddr{IP: u.IP, Port: u.Port, Zone: u.Zone}
+	}
+	return &net.TCPAddr{}
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: alpn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// listener hands out the connections whose peer opened a stream.
+type listener struct {
+	t         *Transport
+	s         *socket
+	ln        *quicgo.Listener
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *listener) loop() {
+	for {
+		qc, err := l.ln.Accept(context.Background())
+		if err != nil {
+			return
+		}
+		l.t.ref(l.s)
+		go l.accept(qc)
+	}
+}
+
+// accept waits for the stream of the connection, connections without a
+// stream must not hold up the others.
+func (l *listener) accept(qc *quicgo.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
+	defer cancel()
+	st, err := qc.AcceptStream(ctx)
+	if err != nil {
+		_ = qc.CloseWithError(0, "no stream")
+		l.t.release(l.s)
+		return
+	}
+	c := l.t.newConn(l.s, qc, st)
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		_ = c.Close()
+	}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		_ = l.ln.Close()
+		l.t.release(l.s)
+	})
+	return nil
+}
+
+func (l *listener) Addr() net.Addr {
+	return tcpAddr(l.s.addr())
+}
+
+// conn is the stream of a QUIC connection.
+type conn struct {
+	*quicgo.Stream
+	qc        *quicgo.Conn
+	closeOnce sync.Once
+}
+
+// Close ends the stream and closes the connection once the remote side
+// has received the written data or lingerTimeout has passed.
+func (c *conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.Stream.CancelRead(0)
+		_ = c.Stream.Close()
+		go func() {
+			timer := time.NewTimer(lingerTimeout)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-c.qc.Context().Done():
+			}
+			_ = c.qc.CloseWithError(0, "")
+		}()
+	})
+	return nil
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return tcpAddr(c.qc.LocalAddr())
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return tcpAddr(c.qc.RemoteAddr())
+}
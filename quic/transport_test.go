@@ -0,0 +1,236 @@
+package quic
+
+import (
+	"bytes"
+	"context"
+	p2p "github.com/xfs-network/xlibp2p"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/discover"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestTransport(t *testing.T) *Transport {
+	tr, err := NewTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// waitClosed waits until all sockets of the transport are closed.
+func waitClosed(t *testing.T, tr *Transport) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tr.mu.Lock()
+		open := len(tr.sockets)
+		tr.mu.Unlock()
+		if open == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d open sockets, want: 0", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransport_dialListen(t *testing.T) {
+	server, client := newTestTransport(t), newTestTransport(t)
+	ln, err := server.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("got listener address: %v", ln.Addr())
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := client.Dial(ctx, addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.RemoteAddr().(*net.TCPAddr).Port != c.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("got remote address: %v, want port of: %v", s.RemoteAddr(), c.LocalAddr())
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(s, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("got %q, err: %v", buf, err)
+	}
+	if _, err = s.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	// the written data reaches the remote side after the close
+	_ = s.Close()
+	if _, err = io.ReadFull(c, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("got %q, err: %v", buf, err)
+	}
+	if _, err = c.Read(buf); err == nil {
+		t.Fatal("read from a closed stream")
+	}
+	_ = c.Close()
+	_ = ln.Close()
+	if _, err = ln.Accept(); err != net.ErrClosed {
+		t.Fatalf("got accept err: %v, want: %v", err, net.ErrClosed)
+	}
+	waitClosed(t, server)
+	waitClosed(t, client)
+}
+
+func TestTransport_sharedSocket(t *testing.T) {
+	tr := newTestTransport(t)
+	pc, err := tr.ListenPacket("127.0.0.1:0", func(packet []byte) bool {
+		return bytes.HasPrefix(packet, []byte("disc"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	ln, err := tr.Listen(pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ln.Addr().(*net.TCPAddr).Port != port {
+		t.Fatalf("got listener port: %d, want: %d", ln.Addr().(*net.TCPAddr).Port, port)
+	}
+	if _, err = tr.ListenPacket(pc.LocalAddr().String(), nil); err != errShared {
+		t.Fatalf("got err: %v, want: %v", err, errShared)
+	}
+	// discovery packets and QUIC connections arrive on the same port
+	sender, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	if _, err = sender.WriteToUDP([]byte("disc-ping"), pc.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, from, err := pc.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "disc-ping" || from.Port != sender.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("got %q from %v, err: %v", buf[:n], from, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := newTestTransport(t).Dial(ctx, ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the socket is kept for the discovery and the connection
+	_ = ln.Close()
+	_ = s.Close()
+	if _, err = pc.WriteToUDP([]byte("disc-pong"), sender.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	_ = pc.Close()
+	if _, _, err = pc.ReadFromUDP(buf); err != net.ErrClosed {
+		t.Fatalf("got read err: %v, want: %v", err, net.ErrClosed)
+	}
+	waitClosed(t, tr)
+}
+
+func newTestServer(t *testing.T, tr *Transport, proto p2p.Protocol, config p2p.Config) p2p.Server {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Key = key
+	config.MaxPeers = 10
+	config.ListenAddr = "127.0.0.1:0"
+	config.Transport = tr
+	config.Discover = true
+	config.NodeDBPath = t.TempDir()
+	srv := p2p.NewServer(config)
+	if err = srv.Bind(proto); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// helloProtocol sends a greeting to every peer and reports the greetings
+// it receives.
+type helloProtocol struct {
+	got chan string
+}
+
+func (h *helloProtocol) Name() string  { return "hello" }
+func (h *helloProtocol) Version() uint { return 1 }
+func (h *helloProtocol) Length() uint8 { return 1 }
+
+func (h *helloProtocol) Run(p p2p.ProtocolPeer) error {
+	if err := p.WriteMessage(0, []byte("hello")); err != nil {
+		return err
+	}
+	select {
+	case msg := <-p.GetProtocolMsgCh():
+		data, err := msg.ReadAll()
+		if err != nil {
+			return err
+		}
+		h.got <- string(data)
+	case <-p.CloseCh():
+		return nil
+	}
+	<-p.CloseCh()
+	return nil
+}
+
+func TestTransport_server(t *testing.T) {
+	protoA, protoB := &helloProtocol{got: make(chan string, 1)}, &helloProtocol{got: make(chan string, 1)}
+	srvA := newTestServer(t, newTestTransport(t), protoA, p2p.Config{})
+	if err := srvA.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srvA.Stop()
+	srvB := newTestServer(t, newTestTransport(t), protoB, p2p.Config{
+		StaticNodes:    []*discover.Node{srvA.Node()},
+		BootstrapNodes: []*discover.Node{srvA.Node()},
+	})
+	events := make(chan *p2p.PeerEvent, 16)
+	sub := srvB.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+	if err := srvB.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srvB.Stop()
+	for _, proto := range []*helloProtocol{protoA, protoB} {
+		select {
+		case got := <-proto.got:
+			if got != "hello" {
+				t.Fatalf("got greeting: %q", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("peers did not exchange messages")
+		}
+	}
+	// the discovery runs on the UDP port of the QUIC listener
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Type == p2p.PeerEventTypeNodeAdded && ev.Peer == srvA.NodeId() {
+				return
+			}
+		case <-timeout:
+			t.Fatal("node not found by the discovery")
+		}
+	}
+}
@@ -0,0 +1,260 @@
+// Package rpc implements request/response calls on top of a p2p.Peer.
+//
+// A Conn uses one message code of a protocol for all of its traffic, the
+// message data is
+//
+//	kind(1byte)+id(8byte)+method(2byte)+payload
+//
+// with integers stored by LittleEndian model. Requests carry the encoded
+// argument, responses the encoded result and error replies the error text.
+// Values are encoded with rawencode, so types implementing
+// rawencode.RawEncoder control their own encoding and others use JSON.
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	p2p "github.com/xfs-network/xlibp2p"
+	"github.com/xfs-network/xlibp2p/common/rawencode"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	kindRequest  uint8 = 0
+	kindResponse uint8 = 1
+	kindError    uint8 = 2
+)
+
+const headerLen = 1 + 8 + 2
+
+// DefaultTimeout bounds calls whose context has no deadline.
+const DefaultTimeout = 10 * time.Second
+
+// maxInflightHandlers is the number of requests of a peer handled at
+// the same time, further requests get an error reply.
+const maxInflightHandlers = 64
+
+var (
+	// ErrClosed is returned by calls on a closed peer.
+	ErrClosed = errors.New("rpc: peer closed")
+	// ErrNotRPC is returned by HandleMsg for messages of other codes.
+	ErrNotRPC = errors.New("rpc: not an rpc message")
+
+	errShortMessage = errors.New("rpc: message too short")
+	errUnknownKind  = errors.New("rpc: unknown message kind")
+)
+
+// RemoteError is returned by Call when the remote handler failed.
+type RemoteError struct {
+	Method  uint16
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("rpc: method %d failed on remote peer: %s", e.Method, e.Message)
+}
+
+// Request is an inbound call passed to a Handler.
+type Request struct {
+	Peer   p2p.Peer
+	Method uint16
+	Data   []byte
+}
+
+// Decode decodes the argument of the call into v.
+func (r *Request) Decode(v interface{}) error {
+	return rawencode.Decode(r.Data, v)
+}
+
+// Handler serves the calls of one method. The returned value is encoded
+// and sent back, a returned error is sent back as RemoteError. The context
+// is canceled when the peer is closed.
+type Handler func(ctx context.Context, req *Request) (interface{}, error)
+
+// Conn matches calls and replies over a single peer. All methods are safe
+// for concurrent use, any number of calls may be in flight.
+type Conn struct {
+	peer  p2p.ProtocolPeer
+	code  uint8
+	ctx   context.Context
+	stop  context.CancelFunc
+	slots chan struct{}
+
+	nextID uint64 // accessed atomically
+
+	mu       sync.Mutex
+	handlers map[uint16]Handler
+	pending  map[uint64]chan *reply
+}
+
+type reply struct {
+	kind uint8
+	data []byte
+}
+
+// NewConn creates a Conn which sends and receives on message code code
+// of the protocol p was passed to.
+func NewConn(p p2p.ProtocolPeer, code uint8) *Conn {
+	ctx, stop := context.WithCancel(context.Background())
+	c := &Conn{
+		peer:     p,
+		code:     code,
+		ctx:      ctx,
+		stop:     stop,
+		slots:    make(chan struct{}, maxInflightHandlers),
+		handlers: make(map[uint16]Handler),
+		pending:  make(map[uint64]chan *reply),
+	}
+	go func() {
+		select {
+		case <-p.CloseCh():
+			stop()
+		case <-ctx.Done():
+		}
+	}()
+	return c
+}
+
+// Handle registers the handler of a method, replacing any earlier one.
+func (c *Conn) Handle(method uint16, h Handler) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.handlers[method] = h
+}
+
+// Call sends a request and decodes the result into resp, which may be
+// nil if the result is not needed. DefaultTimeout applies if ctx has no
+// deadline.
+func (c *Conn) Call(ctx context.Context, method uint16, req, resp interface{}) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultTimeout)
+		defer cancel()
+	}
+	payload, err := rawencode.Encode(req)
+	if err != nil {
+		return err
+	}
+	id := atomic.AddUint64(&c.nextID, 1)
+	ch := make(chan *reply, 1)
+	c.mu.Lock()
+	c.pending[id] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}()
+	if err = c.write(ctx, kindRequest, id, method, payload); err != nil {
+		return err
+	}
+	select {
+	case r := <-ch:
+		if r.kind == kindError {
+			return &RemoteError{Method: method, Message: string(r.data)}
+		}
+		if resp == nil {
+			return nil
+		}
+		return rawencode.Decode(r.data, resp)
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.ctx.Done():
+		return ErrClosed
+	}
+}
+
+// Run passes the messages of the protocol to HandleMsg until the peer
+// is closed. It is meant for protocols which only use RPC, others call
+// HandleMsg from their own loop.
+func (c *Conn) Run() error {
+	defer c.stop()
+	for {
+		select {
+		case msg := <-c.peer.GetProtocolMsgCh():
+			if err := c.HandleMsg(msg); err != nil {
+				return err
+			}
+		case <-c.peer.CloseCh():
+			return nil
+		}
+	}
+}
+
+// HandleMsg processes an inbound message of the protocol. It returns
+// ErrNotRPC for messages of other codes and an error for malformed ones.
+// Requests are handled in their own goroutines.
+func (c *Conn) HandleMsg(msg p2p.MessageReader) error {
+	if msg.Type() != c.code {
+		return ErrNotRPC
+	}
+	data, err := msg.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(data) < headerLen {
+		return errShortMessage
+	}
+	kind := data[0]
+	id := binary.LittleEndian.Uint64(data[1:])
+	method := binary.LittleEndian.Uint16(data[9:])
+	payload := data[headerLen:]
+	switch kind {
+	case kindRequest:
+		select {
+		case c.slots <- struct{}{}:
+		default:
+			return c.write(c.ctx, kindError, id, method, []byte("too many requests"))
+		}
+		go func() {
+			defer func() { <-c.slots }()
+			c.serve(id, method, payload)
+		}()
+	case kindResponse, kindError:
+		c.mu.Lock()
+		ch := c.pending[id]
+		c.mu.Unlock()
+		// replies to calls which gave up are dropped
+		if ch != nil {
+			select {
+			case ch <- &reply{kind: kind, data: payload}:
+			default:
+			}
+		}
+	default:
+		return errUnknownKind
+	}
+	return nil
+}
+
+func (c *Conn) serve(id uint64, method uint16, payload []byte) {
+	c.mu.Lock()
+	h := c.handlers[method]
+	c.mu.Unlock()
+	if h == nil {
+		_ = c.write(c.ctx, kindError, id, method, []byte(fmt.Sprintf("unknown method %d", method)))
+		return
+	}
+	result, err := h(c.ctx, &Request{Peer: c.peer, Method: method, Data: payload})
+	if err == nil {
+		var data []byte
+		if data, err = rawencode.Encode(result); err == nil {
+			_ = c.write(c.ctx, kindResponse, id, method, data)
+			return
+		}
+	}
+	_ = c.write(c.ctx, kindError, id, method, []byte(err.Error()))
+}
+
+func (c *Conn) write(ctx context.Context, kind uint8, id uint64, method uint16, payload []byte) error {
+	data := make([]byte, headerLen, headerLen+len(payload))
+	data[0] = kind
+	binary.LittleEndian.PutUint64(data[1:], id)
+	binary.LittleEndian.PutUint16(data[9:], method)
+	data = append(data, payload...)
+	return c.peer.WriteMessageContext(ctx, c.code, data)
+}
@@ -0,0 +1,156 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	p2p "github.com/xfs-network/xlibp2p"
+	"github.com/xfs-network/xlibp2p/discover"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPeer delivers written messages to the protocol channel of its remote.
+type testPeer struct {
+	remote    *testPeer
+	in        chan p2p.MessageReader
+	close     chan struct{}
+	closeOnce sync.Once
+}
+
+func newTestPeers() (*testPeer, *testPeer) {
+	a := &testPeer{in: make(chan p2p.MessageReader, 16), close: make(chan struct{})}
+	b := &testPeer{in: make(chan p2p.MessageReader, 16), close: make(chan struct{}), remote: a}
+	a.remote = b
+	return a, b
+}
+
+func (tp *testPeer) Is(int) bool                              { return false }
+func (tp *testPeer) ID() discover.NodeId                      { return discover.NodeId{} }
+func (tp *testPeer) Caps() []p2p.Cap                          { return nil }
+func (tp *testPeer) Disconnect(p2p.DiscReason)                { tp.Close() }
+func (tp *testPeer) DiscReason() p2p.DiscReason               { return p2p.DiscRequested }
+func (tp *testPeer) Run()                                     {}
+func (tp *testPeer) CloseCh() chan struct{}                   { return tp.close }
+func (tp *testPeer) GetProtocolMsgCh() chan p2p.MessageReader { return tp.in }
+func (tp *testPeer) WriteMessageObj(uint8, interface{}) error { return errors.New("not supported") }
+func (tp *testPeer) Report(float64, string)                  {}
+func (tp *testPeer) RTT() (time.Duration, time.Duration)     { return 0, 0 }
+
+func (tp *testPeer) Close() {
+	tp.closeOnce.Do(func() { close(tp.close) })
+}
+
+func (tp *testPeer) WriteMessage(mType uint8, data []byte) error {
+	return tp.WriteMessageContext(context.Background(), mType, data)
+}
+
+func (tp *testPeer) TrySend(mType uint8, data []byte) error {
+	return tp.WriteMessage(mType, data)
+}
+
+func (tp *testPeer) WriteMessageContext(ctx context.Context, mType uint8, data []byte) error {
+	raw := []byte{0, mType, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(raw[2:], uint32(len(data)))
+	msg, err := p2p.ReadMessage(bytes.NewReader(append(raw, data...)))
+	if err != nil {
+		return err
+	}
+	select {
+	case tp.remote.in <- msg:
+		return nil
+	case <-tp.close:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type echoArgs struct {
+	Text string
+}
+
+func TestConn_call(t *testing.T) {
+	a, b := newTestPeers()
+	defer a.Close()
+	defer b.Close()
+	client, server := NewConn(a, 0), NewConn(b, 0)
+	go client.Run()
+	go server.Run()
+	release := make(chan struct{})
+	server.Handle(1, func(ctx context.Context, req *Request) (interface{}, error) {
+		var args echoArgs
+		if err := req.Decode(&args); err != nil {
+			return nil, err
+		}
+		if args.Text == "wait" {
+			<-release
+		}
+		return &echoArgs{Text: "echo " + args.Text}, nil
+	})
+	server.Handle(2, func(ctx context.Context, req *Request) (interface{}, error) {
+		return nil, errors.New("broken")
+	})
+
+	// a blocked call must not hold up the others
+	waitErr := make(chan error, 1)
+	go func() {
+		var resp echoArgs
+		waitErr <- client.Call(context.Background(), 1, &echoArgs{Text: "wait"}, &resp)
+	}()
+	var resp echoArgs
+	if err := client.Call(context.Background(), 1, &echoArgs{Text: "hi"}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Text != "echo hi" {
+		t.Fatalf("got response: %q, want: %q", resp.Text, "echo hi")
+	}
+	close(release)
+	if err := <-waitErr; err != nil {
+		t.Fatal(err)
+	}
+
+	err := client.Call(context.Background(), 2, &echoArgs{}, nil)
+	if rerr, ok := err.(*RemoteError); !ok || rerr.Message != "broken" {
+		t.Fatalf("got err: %v, want remote error", err)
+	}
+	err = client.Call(context.Background(), 3, &echoArgs{}, nil)
+	if _, ok := err.(*RemoteError); !ok {
+		t.Fatalf("got err: %v, want remote error for unknown method", err)
+	}
+}
+
+func TestConn_callTimeoutAndClose(t *testing.T) {
+	a, b := newTestPeers()
+	defer b.Close()
+	client, server := NewConn(a, 0), NewConn(b, 0)
+	go client.Run()
+	go server.Run()
+	block := make(chan struct{})
+	defer close(block)
+	server.Handle(1, func(ctx context.Context, req *Request) (interface{}, error) {
+		<-block
+		return nil, nil
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.Call(ctx, 1, &echoArgs{}, nil); err != context.DeadlineExceeded {
+		t.Fatalf("got err: %v, want: %v", err, context.DeadlineExceeded)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		errc <- client.Call(context.Background(), 1, &echoArgs{}, nil)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	a.Close()
+	select {
+	case err := <-errc:
+		if err != ErrClosed {
+			t.Fatalf("got err: %v, want: %v", err, ErrClosed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call not canceled by closing the peer")
+	}
+}
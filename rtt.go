@@ -0,0 +1,111 @@
+package p2p
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultPingInterval is the default time between two heartbeats.
+	defaultPingInterval = time.Second
+	// defaultPeerTimeout is the default time without heartbeat response
+	// after which a peer is disconnected.
+	defaultPeerTimeout = 30 * time.Second
+)
+
+// pingLen is the size of the ping data: nonce(8)+timestamp(8), both
+// LittleEndian. The pong echoes the data of the ping it answers.
+const pingLen = 16
+
+// pingMsg is the data of the heartbeat, timestamp is the send time of
+// the pinging side in unix nanoseconds.
+type pingMsg struct {
+	nonce     uint64
+	timestamp int64
+}
+
+func (m pingMsg) marshal() []byte {
+	data := make([]byte, pingLen)
+	binary.LittleEndian.PutUint64(data[0:], m.nonce)
+	binary.LittleEndian.PutUint64(data[8:], uint64(m.timestamp))
+	return data
+}
+
+// unmarshal parses the data of a ping or pong, the plain heartbeats of
+// older peers are not parsed.
+func (m *pingMsg) unmarshal(data []byte) bool {
+	if len(data) != pingLen {
+		return false
+	}
+	m.nonce = binary.LittleEndian.Uint64(data[0:])
+	m.timestamp = int64(binary.LittleEndian.Uint64(data[8:]))
+	return true
+}
+
+// rttEstimator smooths the round-trip times of the heartbeat like the
+// TCP retransmission timer of RFC 6298, the jitter is the mean deviation.
+type rttEstimator struct {
+	mu     sync.Mutex
+	srtt   time.Duration
+	rttvar time.Duration
+	// pending are the timestamps of the unanswered pings by nonce.
+	pending map[uint64]int64
+}
+
+// ping returns the data of a new ping. Pings which stay unanswered for
+// longer than timeout are forgotten.
+func (e *rttEstimator) ping(now time.Time, timeout time.Duration) []byte {
+	var nonce [8]byte
+	_, _ = rand.Read(nonce[:])
+	m := pingMsg{nonce: binary.LittleEndian.Uint64(nonce[:]), timestamp: now.UnixNano()}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pending == nil {
+		e.pending = make(map[uint64]int64)
+	}
+	for nonce, ts := range e.pending {
+		if now.Sub(time.Unix(0, ts)) > timeout {
+			delete(e.pending, nonce)
+		}
+	}
+	e.pending[m.nonce] = m.timestamp
+	return m.marshal()
+}
+
+// pong takes a sample from the answer to one of our pings and returns
+// it, pongs which answer no pending ping are ignored.
+func (e *rttEstimator) pong(now time.Time, data []byte) (time.Duration, bool) {
+	var m pingMsg
+	if !m.unmarshal(data) {
+		return 0, false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if ts, ok := e.pending[m.nonce]; !ok || ts != m.timestamp {
+		return 0, false
+	}
+	delete(e.pending, m.nonce)
+	rtt := now.Sub(time.Unix(0, m.timestamp))
+	if rtt < 0 {
+		rtt = 0
+	}
+	if e.srtt == 0 {
+		e.srtt, e.rttvar = rtt, rtt/2
+		return rtt, true
+	}
+	dev := e.srtt - rtt
+	if dev < 0 {
+		dev = -dev
+	}
+	e.rttvar = (3*e.rttvar + dev) / 4
+	e.srtt = (7*e.srtt + rtt) / 8
+	return rtt, true
+}
+
+func (e *rttEstimator) get() (time.Duration, time.Duration) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.srtt, e.rttvar
+}
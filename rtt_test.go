@@ -0,0 +1,40 @@
+package p2p
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRTTEstimator(t *testing.T) {
+	var e rttEstimator
+	now := time.Now()
+	data := e.ping(now, time.Minute)
+	if _, ok := e.pong(now, []byte("hello")); ok {
+		t.Fatal("took sample from a pong without nonce")
+	}
+	forged := append([]byte(nil), data...)
+	forged[0]++
+	if _, ok := e.pong(now, forged); ok {
+		t.Fatal("took sample from a pong of an unknown ping")
+	}
+	if rtt, ok := e.pong(now.Add(100*time.Millisecond), data); !ok || rtt != 100*time.Millisecond {
+		t.Fatalf("got rtt: %v, ok: %v, want: %v", rtt, ok, 100*time.Millisecond)
+	}
+	if _, ok := e.pong(now.Add(time.Second), data); ok {
+		t.Fatal("took sample from a pong answered before")
+	}
+	if rtt, jitter := e.get(); rtt != 100*time.Millisecond || jitter != 50*time.Millisecond {
+		t.Fatalf("got rtt: %v, jitter: %v, want: 100ms, 50ms", rtt, jitter)
+	}
+	data = e.ping(now, time.Minute)
+	e.pong(now.Add(200*time.Millisecond), data)
+	if rtt, jitter := e.get(); rtt != 112500*time.Microsecond || jitter != 62500*time.Microsecond {
+		t.Fatalf("got rtt: %v, jitter: %v, want: 112.5ms, 62.5ms", rtt, jitter)
+	}
+	// unanswered pings are forgotten after the timeout
+	e.ping(now, time.Minute)
+	e.ping(now.Add(2*time.Minute), time.Minute)
+	if len(e.pending) != 1 {
+		t.Fatalf("got pending pings: %d, want: 1", len(e.pending))
+	}
+}
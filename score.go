@@ -0,0 +1,243 @@
+package p2p
+
+import (
+	"github.com/xfs-network/xlibp2p/discover"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Score changes reported by the core when a peer misbehaves, protocols
+// may use them for comparable faults in Peer.Report.
+const (
+	ScoreProtocolError    float64 = -25
+	ScoreOversizedMessage float64 = -50
+)
+
+const (
+	// defaultBanThreshold is the default score under which peers are banned.
+	defaultBanThreshold = -100
+	// defaultBanDuration is the default time a banned peer may not connect.
+	defaultBanDuration = time.Hour
+	// defaultScoreHalfLife is the default time in which a score decays to half.
+	defaultScoreHalfLife = 10 * time.Minute
+	// maxScore bounds the credit a peer may build up by good behavior.
+	maxScore = 100
+	// maxScores bounds the number of kept scores, the score closest to
+	// zero is evicted to make room for a new one.
+	maxScores = 10000
+)
+
+// banStore persists bans, it is implemented by the discovery table.
+type banStore interface {
+	Ban(b discover.Ban) error
+	Bans() []discover.Ban
+}
+
+// score is the reputation of a peer, it decays towards zero.
+type score struct {
+	value   float64
+	updated time.Time
+}
+
+func (s *score) at(now time.Time, halfLife time.Duration) float64 {
+	elapsed := now.Sub(s.updated)
+	if elapsed <= 0 {
+		return s.value
+	}
+	return s.value * math.Pow(0.5, float64(elapsed)/float64(halfLife))
+}
+
+// scoreBoard keeps the scores of peers and the bans of those whose score
+// fell under the threshold. A nil scoreBoard bans nobody.
+type scoreBoard struct {
+	threshold float64
+	duration  time.Duration
+	halfLife  time.Duration
+	mu        sync.Mutex
+	store     banStore
+	// pruned is the last time decayed scores and expired bans were dropped.
+	pruned    time.Time
+	scores    map[discover.NodeId]*score
+	bans      map[discover.NodeId]time.Time
+	ipBans    map[string]time.Time
+}
+
+func newScoreBoard(config Config) *scoreBoard {
+	b := &scoreBoard{
+		threshold: config.BanThreshold,
+		duration:  config.BanDuration,
+		halfLife:  config.ScoreHalfLife,
+		scores:    make(map[discover.NodeId]*score),
+		bans:      make(map[discover.NodeId]time.Time),
+		ipBans:    make(map[string]time.Time),
+	}
+	if b.threshold == 0 {
+		b.threshold = defaultBanThreshold
+	}
+	if b.duration <= 0 {
+		b.duration = defaultBanDuration
+	}
+	if b.halfLife <= 0 {
+		b.halfLife = defaultScoreHalfLife
+	}
+	return b
+}
+
+// setStore persists new bans in store and loads the bans it holds.
+func (b *scoreBoard) setStore(store banStore) {
+	bans := store.Bans()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.store = store
+	for _, ban := range bans {
+		b.addBan(ban)
+	}
+}
+
+// report changes the score of a peer and reports whether the peer
+// has been banned because of it.
+func (b *scoreBoard) report(id discover.NodeId, ip net.IP, delta float64) bool {
+	if b == nil {
+		return false
+	}
+	now := time.Now()
+	b.mu.Lock()
+	if now.Sub(b.pruned) >= b.halfLife {
+		b.prune(now)
+	}
+	s := b.scores[id]
+	if s == nil {
+		if len(b.scores) >= maxScores {
+			b.evict(now)
+		}
+		s = new(score)
+		b.scores[id] = s
+	}
+	s.value, s.updated = math.Min(s.at(now, b.halfLife)+delta, maxScore), now
+	if s.value >= b.threshold {
+		b.mu.Unlock()
+		return false
+	}
+	delete(b.scores, id)
+	ban := discover.Ban{ID: id, IP: ip, Until: now.Add(b.duration)}
+	b.addBan(ban)
+	store := b.store
+	b.mu.Unlock()
+	if store != nil {
+		_ = store.Ban(ban)
+	}
+	return true
+}
+
+func (b *scoreBoard) addBan(ban discover.Ban) {
+	b.bans[ban.ID] = ban.Until
+	if ban.IP != nil {
+		b.ipBans[ban.IP.String()] = ban.Until
+	}
+}
+
+// prune drops the scores which decayed to nearly zero and the expired
+// bans, the caller must hold mu.
+func (b *scoreBoard) prune(now time.Time) {
+	b.pruned = now
+	for id, s := range b.scores {
+		if math.Abs(s.at(now, b.halfLife)) < 1 {
+			delete(b.scores, id)
+		}
+	}
+	for id, until := range b.bans {
+		if !now.Before(until) {
+			delete(b.bans, id)
+		}
+	}
+	for ip, until := range b.ipBans {
+		if !now.Before(until) {
+			delete(b.ipBans, ip)
+		}
+	}
+}
+
+// evict drops the score closest to zero, the caller must hold mu.
+func (b *scoreBoard) evict(now time.Time) {
+	var (
+		victim discover.NodeId
+		least  = math.Inf(1)
+	)
+	for id, s := range b.scores {
+		if v := math.Abs(s.at(now, b.halfLife)); v < least {
+			victim, least = id, v
+		}
+	}
+	delete(b.scores, victim)
+}
+
+// forget drops the score of a disconnected peer once it has decayed,
+// scores of misbehaving peers are kept so they can not be reset by
+// reconnecting.
+func (b *scoreBoard) forget(id discover.NodeId) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s := b.scores[id]; s != nil && math.Abs(s.at(time.Now(), b.halfLife)) < 1 {
+		delete(b.scores, id)
+	}
+}
+
+// banned reports whether the node or the IP is banned.
+func (b *scoreBoard) banned(id discover.NodeId, ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until, ok := b.bans[id]; ok {
+		if now.Before(until) {
+			return true
+		}
+		delete(b.bans, id)
+	}
+	return b.bannedIP(ip, now)
+}
+
+// bannedIP reports whether the IP is banned, the caller must hold mu.
+func (b *scoreBoard) bannedIP(ip net.IP, now time.Time) bool {
+	if ip == nil {
+		return false
+	}
+	key := ip.String()
+	until, ok := b.ipBans[key]
+	if !ok {
+		return false
+	}
+	if now.Before(until) {
+		return true
+	}
+	delete(b.ipBans, key)
+	return false
+}
+
+// bannedAddr reports whether connections from the address are refused.
+func (b *scoreBoard) bannedAddr(addr net.Addr) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.bannedIP(addrIP(addr), time.Now())
+}
+
+// addrIP returns the IP of TCP and UDP addresses, or nil.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package p2p
+
+import (
+	"github.com/xfs-network/xlibp2p/discover"
+	"net"
+	"testing"
+	"time"
+)
+
+type testBanStore struct {
+	bans []discover.Ban
+}
+
+func (s *testBanStore) Ban(b discover.Ban) error {
+	s.bans = append(s.bans, b)
+	return nil
+}
+
+func (s *testBanStore) Bans() []discover.Ban {
+	return s.bans
+}
+
+func TestScoreBoard_report(t *testing.T) {
+	store := new(testBanStore)
+	b := newScoreBoard(Config{BanThreshold: -100, BanDuration: time.Minute})
+	b.setStore(store)
+	id, ip := discover.NodeId{1}, net.IP{10, 0, 0, 1}
+	if b.report(id, ip, 50) || b.report(id, ip, -100) {
+		t.Fatal("peer banned above the threshold")
+	}
+	// the credit of a peer is bounded
+	b.report(id, ip, 1000)
+	if b.report(id, ip, -150) {
+		t.Fatal("peer banned above the threshold")
+	}
+	if !b.report(id, ip, -100) {
+		t.Fatal("peer not banned under the threshold")
+	}
+	if !b.banned(id, nil) || !b.banned(discover.NodeId{2}, ip) {
+		t.Fatal("ban not applied to the node id and ip")
+	}
+	if !b.bannedAddr(&net.TCPAddr{IP: ip, Port: 9001}) || b.bannedAddr(&net.TCPAddr{IP: net.IP{10, 0, 0, 2}}) {
+		t.Fatal("got wrong banned state of address")
+	}
+	if len(store.bans) != 1 || store.bans[0].ID != id || !store.bans[0].IP.Equal(ip) {
+		t.Fatalf("got stored bans: %+v", store.bans)
+	}
+	// stored bans are loaded by another board
+	other := newScoreBoard(Config{})
+	other.setStore(store)
+	if !other.banned(id, nil) {
+		t.Fatal("stored ban not loaded")
+	}
+}
+
+func TestScoreBoard_decay(t *testing.T) {
+	b := newScoreBoard(Config{ScoreHalfLife: time.Minute})
+	id := discover.NodeId{1}
+	b.report(id, nil, -80)
+	b.scores[id].updated = time.Now().Add(-time.Minute)
+	// -80 decayed to -40, the peer stays above the default threshold
+	if b.report(id, nil, -50) {
+		t.Fatal("score did not decay")
+	}
+	b.forget(id)
+	if b.scores[id] == nil {
+		t.Fatal("forgot the score of a misbehaving peer")
+	}
+	b.scores[id].updated = time.Now().Add(-time.Hour)
+	b.forget(id)
+	if b.scores[id] != nil {
+		t.Fatal("decayed score not forgotten")
+	}
+}
+
+func TestScoreBoard_banExpires(t *testing.T) {
+	b := newScoreBoard(Config{})
+	id, ip := discover.NodeId{1}, net.IP{10, 0, 0, 1}
+	b.addBan(discover.Ban{ID: id, IP: ip, Until: time.Now().Add(-time.Second)})
+	if b.banned(id, ip) {
+		t.Fatal("expired ban applied")
+	}
+	if len(b.bans) != 0 || len(b.ipBans) != 0 {
+		t.Fatal("expired ban not deleted")
+	}
+	var nilBoard *scoreBoard
+	if nilBoard.report(id, ip, -1000) || nilBoard.banned(id, ip) {
+		t.Fatal("nil board banned a peer")
+	}
+}
+
+func TestScoreBoard_prune(t *testing.T) {
+	b := newScoreBoard(Config{ScoreHalfLife: time.Minute})
+	for i := 0; i < 3; i++ {
+		b.report(discover.NodeId{byte(i)}, nil, -50)
+	}
+	b.scores[discover.NodeId{0}].updated = time.Now().Add(-time.Hour)
+	b.bans[discover.NodeId{0}] = time.Now().Add(-time.Second)
+	b.pruned = time.Now().Add(-time.Minute)
+	// reports of other peers drop the decayed scores and expired bans
+	b.report(discover.NodeId{3}, nil, -50)
+	if b.scores[discover.NodeId{0}] != nil || len(b.bans) != 0 {
+		t.Fatal("decayed score or expired ban not pruned")
+	}
+	if len(b.scores) != 3 {
+		t.Fatalf("got %d scores, want 3", len(b.scores))
+	}
+	// a full board evicts the score closest to zero
+	for i := len(b.scores); i < maxScores; i++ {
+		b.scores[discover.NodeId{1, byte(i), byte(i >> 8)}] = &score{value: -50, updated: time.Now()}
+	}
+	b.scores[discover.NodeId{1}].value = -10
+	b.report(discover.NodeId{4}, nil, -50)
+	if len(b.scores) != maxScores || b.scores[discover.NodeId{1}] != nil {
+		t.Fatal("score closest to zero not evicted from a full board")
+	}
+}
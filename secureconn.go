@@ -0,0 +1,160 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/hkdf"
+	"io"
+	"net"
+	"sync"
+)
+
+// secureFrameSize is the maximum amount of plaintext sealed into a single frame,
+// larger writes are split into several frames.
+const secureFrameSize = 1 << 16
+
+var secureKeyInfo = []byte("xlibp2p secure channel")
+
+// secrets holds the session keys derived from the handshake.
+type secrets struct {
+	egress  []byte
+	ingress []byte
+}
+
+// deriveSecrets expands the ECDH shared secret into a pair of AES-256 keys,
+// one for each direction of the connection. Both nonces of the handshake
+// are used as salt so that every session gets fresh keys.
+func deriveSecrets(shared []byte, initNonce, respNonce []byte, initiator bool) (*secrets, error) {
+	salt := make([]byte, 0, len(initNonce)+len(respNonce))
+	salt = append(salt, initNonce...)
+	salt = append(salt, respNonce...)
+	kdf := hkdf.New(sha256.New, shared, salt, secureKeyInfo)
+	initKey := make([]byte, 32)
+	respKey := make([]byte, 32)
+	if _, err := io.ReadFull(kdf, initKey); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(kdf, respKey); err != nil {
+		return nil, err
+	}
+	if initiator {
+		return &secrets{egress: initKey, ingress: respKey}, nil
+	}
+	return &secrets{egress: respKey, ingress: initKey}, nil
+}
+
+// secureConn wraps a net.Conn into an AEAD (AES-GCM) framed channel.
+// frame = length(4byte)+ciphertext, the length is authenticated as
+// additional data and the nonce is a per-direction counter.
+type secureConn struct {
+	net.Conn
+	wmu      sync.Mutex
+	enc      cipher.AEAD
+	encNonce uint64
+	rmu      sync.Mutex
+	dec      cipher.AEAD
+	decNonce uint64
+	br       *bufio.Reader
+	// frame is reused for every inbound frame, rbuf points into it
+	// and is drained before the next frame is read.
+	frame []byte
+	rbuf  []byte
+}
+
+func newSecureConn(conn net.Conn, s *secrets) (*secureConn, error) {
+	enc, err := newGCM(s.egress)
+	if err != nil {
+		return nil, err
+	}
+	dec, err := newGCM(s.ingress)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{
+		Conn:  conn,
+		enc:   enc,
+		dec:   dec,
+		br:    bufio.NewReader(conn),
+		frame: make([]byte, secureFrameSize+dec.Overhead()),
+	}, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func counterNonce(aead cipher.AEAD, n uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.LittleEndian.PutUint64(nonce[len(nonce)-8:], n)
+	return nonce
+}
+
+// Write seals the given data into one or more frames and writes them
+// to the underlying connection.
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	written := 0
+	for written < len(b) {
+		end := written + secureFrameSize
+		if end > len(b) {
+			end = len(b)
+		}
+		chunk := b[written:end]
+		frame := make([]byte, 4, 4+len(chunk)+c.enc.Overhead())
+		binary.LittleEndian.PutUint32(frame, uint32(len(chunk)+c.enc.Overhead()))
+		frame = c.enc.Seal(frame, counterNonce(c.enc, c.encNonce), chunk, frame[:4])
+		c.encNonce++
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		written = end
+	}
+	return written, nil
+}
+
+// Read returns decrypted data, reading and opening the next frame
+// when no plaintext is buffered.
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+	if len(c.rbuf) == 0 {
+		if err := c.readFrame(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *secureConn) readFrame() error {
+	var header [4]byte
+	if _, err := io.ReadFull(c.br, header[:]); err != nil {
+		return err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size < uint32(c.dec.Overhead()) || size > uint32(secureFrameSize+c.dec.Overhead()) {
+		return fmt.Errorf("invalid secure frame size: %d", size)
+	}
+	frame := c.frame[:size]
+	if _, err := io.ReadFull(c.br, frame); err != nil {
+		return err
+	}
+	plain, err := c.dec.Open(frame[:0], counterNonce(c.dec, c.decNonce), frame, header[:])
+	if err != nil {
+		return errors.New("secure frame authentication failed")
+	}
+	c.decNonce++
+	c.rbuf = plain
+	return nil
+}
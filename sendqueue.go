@@ -0,0 +1,196 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// defaultSendQueueSize is the default number of protocol messages
+	// queued for a peer.
+	defaultSendQueueSize = 256
+	// controlQueueSize is the number of queued messages of the base
+	// protocol, they are sent before any protocol message.
+	controlQueueSize = 16
+	// defaultWriteTimeout is the default time a single message may take
+	// to be written before the peer is disconnected.
+	defaultWriteTimeout = 20 * time.Second
+)
+
+var (
+	// ErrSendQueueFull is returned by writes to a peer which can not keep
+	// up with the messages sent to it.
+	ErrSendQueueFull = errors.New("send queue full")
+
+	errPeerClosed = errors.New("peer closed")
+)
+
+// SendPolicy decides what happens to a message written to a peer whose
+// send queue is full.
+type SendPolicy uint8
+
+const (
+	// SendBlock makes the write wait for room in the queue, the wait can
+	// be bounded with WriteMessageContext.
+	SendBlock SendPolicy = iota
+	// SendDrop drops the message and fails the write with ErrSendQueueFull.
+	SendDrop
+	// SendDisconnect disconnects the peer with DiscSlowPeer and fails the
+	// write with ErrSendQueueFull.
+	SendDisconnect
+)
+
+var sendPolicyToString = [...]string{
+	SendBlock:      "block",
+	SendDrop:       "drop",
+	SendDisconnect: "disconnect",
+}
+
+func (sp SendPolicy) String() string {
+	if int(sp) < len(sendPolicyToString) {
+		return sendPolicyToString[sp]
+	}
+	return "unknown"
+}
+
+// outMsg is a message waiting in the send queue of a peer. The message
+// is skipped if ctx is done before it is written, and the deadline of ctx
+// also bounds the write.
+type outMsg struct {
+	ctx   context.Context
+	mType uint8
+	data  []byte
+}
+
+// sendQueue holds the outbound messages of a peer, they are written by
+// the single writer goroutine of the peer. Control messages of the base
+// protocol have their own queue and are always written first.
+type sendQueue struct {
+	control chan outMsg
+	proto   chan outMsg
+	policy  SendPolicy
+	timeout time.Duration
+}
+
+func newSendQueue(config Config) *sendQueue {
+	size := config.SendQueueSize
+	if size <= 0 {
+		size = defaultSendQueueSize
+	}
+	q := &sendQueue{
+		control: make(chan outMsg, controlQueueSize),
+		proto:   make(chan outMsg, size),
+		policy:  config.SendPolicy,
+		timeout: config.WriteTimeout,
+	}
+	if q.timeout <= 0 {
+		q.timeout = defaultWriteTimeout
+	}
+	return q
+}
+
+func (q *sendQueue) queue(mType uint8) chan outMsg {
+	if mType < baseProtocolLength {
+		return q.control
+	}
+	return q.proto
+}
+
+// TrySend queues a message without waiting, it returns ErrSendQueueFull
+// if the queue is full. The send policy does not apply.
+func (p *peer) TrySend(mType uint8, data []byte) error {
+	return p.trySend(context.Background(), mType, data)
+}
+
+func (p *peer) trySend(ctx context.Context, mType uint8, data []byte) error {
+	select {
+	case <-p.close:
+		return errPeerClosed
+	default:
+	}
+	select {
+	case p.sendq.queue(mType) <- outMsg{ctx: ctx, mType: mType, data: data}:
+		p.countTraffic("egress", mType, len(data))
+		return nil
+	default:
+		p.countDropped(mType)
+		return ErrSendQueueFull
+	}
+}
+
+// send queues a message and applies the send policy if the queue is full.
+// Control messages are never waited for, heartbeats dropped from a full
+// queue are made up for by the next ones.
+func (p *peer) send(ctx context.Context, mType uint8, data []byte) error {
+	err := p.trySend(ctx, mType, data)
+	if err != ErrSendQueueFull || mType < baseProtocolLength {
+		return err
+	}
+	switch p.sendq.policy {
+	case SendDrop:
+		return err
+	case SendDisconnect:
+		p.logger.Infof("peer %s can not keep up with the sent messages", p.id)
+		p.Disconnect(DiscSlowPeer)
+		return err
+	}
+	select {
+	case p.sendq.proto <- outMsg{ctx: ctx, mType: mType, data: data}:
+		p.countTraffic("egress", mType, len(data))
+		return nil
+	case <-p.close:
+		return errPeerClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// writeLoop writes the queued messages until the peer is closed, a
+// failed or timed out write disconnects the peer.
+func (p *peer) writeLoop() {
+	for {
+		var msg outMsg
+		select {
+		case msg = <-p.sendq.control:
+		default:
+			select {
+			case msg = <-p.sendq.control:
+			case msg = <-p.sendq.proto:
+			case <-p.close:
+				return
+			}
+		}
+		if msg.ctx.Err() != nil {
+			continue
+		}
+		deadline := time.Now().Add(p.sendq.timeout)
+		if d, ok := msg.ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		// a write cut off by the deadline leaves a partial message on
+		// the wire, so the peer is disconnected like after a timeout
+		n, err := p.conn.writeMessageDeadline(msg.mType, msg.data, deadline, p.close)
+		if err != nil {
+			select {
+			case <-p.close:
+			default:
+				p.logger.Debugf("write to peer %s err: %v", p.id, err)
+			}
+			p.Disconnect(DiscNetworkError)
+			return
+		}
+		if !throttle(n, p.close, p.limiters(msg.mType, true)...) {
+			return
+		}
+	}
+}
+
+// countDropped records a message which did not fit into the send queue.
+func (p *peer) countDropped(mType uint8) {
+	priority := "control"
+	if mType >= baseProtocolLength {
+		priority = "protocol"
+	}
+	p.metrics.Counter("p2p_send_queue_full_total", "priority", priority).Inc()
+}
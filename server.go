@@ -2,12 +2,18 @@ package p2p
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"errors"
+	"fmt"
 	"github.com/xfs-network/xlibp2p/discover"
 	"github.com/xfs-network/xlibp2p/log"
+	"github.com/xfs-network/xlibp2p/metrics"
 	"github.com/xfs-network/xlibp2p/nat"
+	"github.com/xfs-network/xlibp2p/netutil"
+	"math"
 	"net"
+	"net/http"
 	"sync"
 	"time"
 )
@@ -24,9 +30,22 @@ type Server interface {
 	Node() *discover.Node
 	NodeId() discover.NodeId
 	Peers() []Peer
+	// PeersInfo returns a snapshot of the connected peers.
+	PeersInfo() []*PeerInfo
+	// Peer returns a snapshot of a connected peer, or nil.
+	Peer(id discover.NodeId) *PeerInfo
+	// Bandwidth returns the measured traffic and the rate limits of the
+	// server, its peers and protocols.
+	Bandwidth() BandwidthStats
 	AddPeer(node *discover.Node)
+	// AddPeerContext is like AddPeer but returns an error if the server
+	// is not running or ctx is done before the node was handed over.
+	AddPeerContext(ctx context.Context, node *discover.Node) error
 	RemovePeer(node discover.NodeId)
-	Bind(p Protocol)
+	Bind(p Protocol) error
+	// SubscribeEvents delivers the events of the server to ch. Events are
+	// dropped if ch is not ready to receive, so ch should be buffered.
+	SubscribeEvents(ch chan<- *PeerEvent) Subscription
 	Start() error
 	Stop()
 }
@@ -50,8 +69,26 @@ type server struct {
 	addstatic chan *discover.Node
 	rmstatic chan discover.NodeId
 	delpeer chan Peer
+	// peers is only changed by the run loop, it holds peersMu then so
+	// that other goroutines can read it.
+	peersMu sync.RWMutex
 	peers map[discover.NodeId]Peer
 	table *discover.Table
+	listeners []net.Listener
+	metricsSrv *http.Server
+	// pendingSlots limits the number of inbound handshakes.
+	pendingSlots chan struct{}
+	// loopWG tracks the run loop, the listener, inbound handshakes and
+	// the NAT mapping so that Stop can wait for them.
+	loopWG sync.WaitGroup
+	events eventFeed
+	scores *scoreBoard
+	// traffic and udpTraffic limit the TCP traffic of all peers and the
+	// discovery traffic, the per protocol scopes are kept under trafficMu.
+	traffic *bandwidth
+	udpTraffic *bandwidth
+	trafficMu sync.Mutex
+	protoTraffic map[string]*bandwidth
 	logger log.Logger
 	lastLookup time.Time
 }
@@ -60,21 +97,111 @@ type server struct {
 type Config struct {
 	Nat nat.Mapper
 	ListenAddr      string
+	// ListenAddrs are further addresses the server listens on, e.g. the
+	// IPv6 address of a dual-stack host. Only their hosts are used, all
+	// listeners share the port of ListenAddr. Specified IPs are announced
+	// in node discovery and dialed when ListenAddr is unreachable.
+	ListenAddrs []string
 	Key             *ecdsa.PrivateKey
 	Discover bool
 	NodeDBPath string
 	StaticNodes     []*discover.Node
 	BootstrapNodes []*discover.Node
+	// MaxPeers is the maximum number of connected peers, static peers
+	// are neither limited nor counted against it. Zero means no limit,
+	// dynamic peers are then not dialed.
 	MaxPeers int
+	// MaxPendingPeers is the maximum number of inbound connections in the
+	// handshake phase, zero defaults to defaultMaxPendingPeers.
+	MaxPendingPeers int
+	// MaxInboundRatio is the part of MaxPeers which may be taken by inbound
+	// connections, zero means inbound connections may use all of MaxPeers.
+	MaxInboundRatio float64
+	// MaxMessageSize is the maximum data size of protocol messages, zero
+	// defaults to defaultMaxMsgSize. Protocols may set their own limit by
+	// implementing MsgSizeLimiter.
+	MaxMessageSize uint32
+	// Compression lists the codecs offered in the protocol handshake in
+	// order of preference, nil offers snappy. Messages are compressed with
+	// the first codec offered by the dialing side which both sides offer,
+	// see RegisterCodec.
+	Compression []string
+	// NoCompression disables the compression of messages.
+	NoCompression bool
+	// CompressThreshold is the data size from which protocol messages are
+	// compressed, zero defaults to defaultCompressThreshold.
+	CompressThreshold uint32
+	// PingInterval is the time between two heartbeats of a peer, zero
+	// defaults to defaultPingInterval. The heartbeat measures Peer.RTT.
+	PingInterval time.Duration
+	// PeerTimeout is the time without heartbeat response after which a
+	// peer is disconnected, zero defaults to defaultPeerTimeout.
+	PeerTimeout time.Duration
+	// SendQueueSize is the number of protocol messages queued for each
+	// peer, zero defaults to defaultSendQueueSize.
+	SendQueueSize int
+	// SendPolicy decides what happens to messages written to a peer whose
+	// send queue is full, the default SendBlock waits for room.
+	SendPolicy SendPolicy
+	// WriteTimeout is the time a single message may take to be written
+	// before the peer is disconnected, zero defaults to defaultWriteTimeout.
+	WriteTimeout time.Duration
+	// RateLimit limits the TCP traffic of all peers together, in bytes
+	// per second. Messages wait until the limit permits them.
+	RateLimit netutil.RateLimit
+	// PeerRateLimit limits the TCP traffic of each peer.
+	PeerRateLimit netutil.RateLimit
+	// ProtocolRateLimits limits the traffic of protocols by name, the
+	// limit of a protocol is shared by all peers running it.
+	ProtocolRateLimits map[string]netutil.RateLimit
+	// DiscoveryRateLimit limits the UDP traffic of node discovery,
+	// packets exceeding it are dropped.
+	DiscoveryRateLimit netutil.RateLimit
+	// Transport creates the peer connections, nil defaults to TCPTransport.
+	Transport Transport
+	// NetRestrict limits connections and node discovery to the permitted
+	// networks, nil permits all networks.
+	NetRestrict *netutil.Restriction
+	// BanThreshold is the score under which a peer is disconnected and
+	// banned, zero defaults to defaultBanThreshold. Scores start at zero
+	// and are changed by Peer.Report.
+	BanThreshold float64
+	// BanDuration is the time a banned peer may not connect, zero
+	// defaults to defaultBanDuration. Bans are kept in the node
+	// database if discovery is enabled.
+	BanDuration time.Duration
+	// ScoreHalfLife is the time in which a score decays to half,
+	// zero defaults to defaultScoreHalfLife.
+	ScoreHalfLife time.Duration
+	// Metrics receives the metrics of the server and node discovery,
+	// nothing is recorded if it is nil.
+	Metrics metrics.Registry
+	// MetricsAddr is the address of the HTTP endpoint which serves Metrics
+	// in the Prometheus text format, Metrics must then implement
+	// metrics.Exporter. The endpoint is disabled if it is empty.
+	MetricsAddr string
 	Logger log.Logger
 	Encoder encoder
 }
 
+var (
+	errServerStopped = errors.New("server not running")
+	errNotPermitted  = errors.New("address not permitted")
+)
+
+// defaultMaxPendingPeers is the default limit of inbound connections
+// in the handshake phase.
+const defaultMaxPendingPeers = 50
+
 // NewServer Creates background service object
 func NewServer(config Config) Server {
 	srv := &server{
 		config:  config,
 		logger: config.Logger,
+		scores: newScoreBoard(config),
+		traffic: newBandwidth(config.RateLimit),
+		udpTraffic: newBandwidth(config.DiscoveryRateLimit),
+		protoTraffic: make(map[string]*bandwidth),
 	}
 	if config.Logger == nil {
 		srv.logger = log.DefaultLogger()
@@ -84,35 +211,89 @@ func NewServer(config Config) Server {
 	return srv
 }
 
-// Bind network protocol function
-func (srv *server) Bind(p Protocol) {
+// Bind network protocol function. Protocols must be bound before the server
+// is started, binding the same name and version twice is an error. The
+// protocol handshake limits names to 255 bytes, versions to 32 bits and
+// the number of protocols to 255.
+func (srv *server) Bind(p Protocol) error {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if srv.running {
+		return errors.New("bind protocol on running server")
+	}
+	name := p.Name()
+	if name == "" || len(name) > math.MaxUint8 {
+		return fmt.Errorf("invalid protocol name: %q", name)
+	}
+	if uint64(p.Version()) > math.MaxUint32 {
+		return fmt.Errorf("invalid version of protocol %s: %d", name, p.Version())
+	}
+	if len(srv.protocols) >= math.MaxUint8 {
+		return fmt.Errorf("bind protocol %s: too many protocols", name)
+	}
+	for _, item := range srv.protocols {
+		if item.Name() == name && item.Version() == p.Version() {
+			return fmt.Errorf("protocol %s/%d already bound", name, p.Version())
+		}
+	}
 	if srv.protocols == nil {
 		srv.protocols = make([]Protocol, 0)
 	}
 	// Add network protocol
 	srv.protocols = append(srv.protocols, p)
+	return nil
 }
 
-// Stop background network function
+// Stop background network function. It closes the listener, disconnects
+// all peers and waits until every goroutine of the server has exited.
+// Stop does nothing if the server is not running.
 func (srv *server) Stop() {
+	srv.mu.Lock()
+	if !srv.running {
+		srv.mu.Unlock()
+		return
+	}
+	srv.running = false
+	srv.closeListeners()
+	if srv.metricsSrv != nil {
+		_ = srv.metricsSrv.Close()
+	}
 	close(srv.close)
-	srv.table.Close()
+	srv.mu.Unlock()
+	srv.loopWG.Wait()
+	if srv.table != nil {
+		srv.table.Close()
+	}
+	srv.logger.Infof("p2p server stopped")
 }
 
 type udpcnn interface {
 	LocalAddr() net.Addr
 }
 
-func (srv *server) listenUDP() (*discover.Table, udpcnn, error ) {
+func (srv *server) listenUDP(altIPs []net.IP) (*discover.Table, udpcnn, error ) {
 	addr, err := net.ResolveUDPAddr("udp", srv.config.ListenAddr)
 	if err != nil {
 		return nil, nil, err
 	}
-	conn, err := net.ListenUDP("udp", addr)
+	var conn PacketConn
+	if pt, ok := srv.transport().(PacketTransport); ok {
+		conn, err = pt.ListenPacket(addr.String(), discover.IsPacket)
+	} else {
+		conn, err = net.ListenUDP("udp", addr)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
-	table, _ := discover.NewUDP(srv.config.Key, conn, srv.config.NodeDBPath, srv.config.Nat)
+	table, _ := discover.NewUDP(srv.config.Key, conn, discover.Config{
+		NodeDBPath:  srv.config.NodeDBPath,
+		Nat:         srv.config.Nat,
+		AltIPs:      altIPs,
+		Metrics:     srv.config.Metrics,
+		NetRestrict: srv.config.NetRestrict,
+		Ingress:     srv.udpTraffic.ingress,
+		Egress:      srv.udpTraffic.egress,
+	})
 	return table, conn, nil
 }
 
@@ -124,41 +305,88 @@ func (srv *server) Start() error {
 		return errors.New("server already running")
 	}
 
-	srv.running = true
+	// list the bound protocols in the bandwidth stats before their first peer
+	for _, p := range srv.protocols {
+		srv.protocolTraffic(p.Name())
+	}
+
 	// Peer to peer session entity
 	srv.addpeer = make(chan *peerConn)
 	srv.addstatic = make(chan *discover.Node)
 	srv.rmstatic = make(chan discover.NodeId)
 	srv.delpeer = make(chan Peer)
 	srv.close = make(chan struct{})
-	var err error
+	maxPending := srv.config.MaxPendingPeers
+	if maxPending <= 0 {
+		maxPending = defaultMaxPendingPeers
+	}
+	srv.pendingSlots = make(chan struct{}, maxPending)
+	for i := 0; i < maxPending; i++ {
+		srv.pendingSlots <- struct{}{}
+	}
+	srv.table = nil
+	altIPs, err := srv.altIPs()
+	if err != nil {
+		return err
+	}
 	var uconn udpcnn = nil
 	// launch node discovery and UDP listener
 	if srv.config.Discover {
-		srv.table, uconn, err = srv.listenUDP()
+		srv.table, uconn, err = srv.listenUDP(altIPs)
 		if err != nil {
 			return err
 		}
+		srv.scores.setStore(srv.table)
+		srv.table.SetNodeHooks(func(n *discover.Node) {
+			srv.events.send(&PeerEvent{Type: PeerEventTypeNodeAdded, Peer: n.ID})
+		}, func(n *discover.Node) {
+			srv.events.send(&PeerEvent{Type: PeerEventTypeNodeRemoved, Peer: n.ID})
+		})
 
 	}
 	dynPeers := srv.config.MaxPeers / 2
 	if !srv.config.Discover {
 		dynPeers = 0
 	}
-	dialer := newDialState(srv.config.StaticNodes, srv.table, dynPeers)
+	dialer := newDialState(srv.nodeId, srv.config.StaticNodes, srv.table, dynPeers)
+	dialer.banned = func(n *discover.Node) bool {
+		return srv.scores.banned(n.ID, n.IP)
+	}
 	// launch TCP listener to accept connection
-	realaddr := uconn.LocalAddr().(*net.UDPAddr)
-	if err = srv.listenAndServe(realaddr.Port); err != nil {
+	realPort := 0
+	if uconn != nil {
+		realPort = uconn.LocalAddr().(*net.UDPAddr).Port
+	}
+	if err = srv.listenAndServe(realPort, altIPs); err != nil {
+		if srv.table != nil {
+			srv.table.Close()
+		}
+		return err
+	}
+	if err = srv.startMetrics(); err != nil {
+		srv.closeListeners()
+		close(srv.close)
+		srv.loopWG.Wait()
+		if srv.table != nil {
+			srv.table.Close()
+		}
 		return err
 	}
 
+	srv.loopWG.Add(1)
 	go srv.run(dialer)
 	srv.running = true
 	return nil
 }
 
 func (srv *server) run(dialer *dialstate) {
+	defer srv.loopWG.Done()
+	srv.peersMu.Lock()
 	srv.peers = make(map[discover.NodeId]Peer)
+	srv.peersMu.Unlock()
+	// running counts the peers whose runPeer has not returned, replaced
+	// duplicates are no longer in srv.peers but still have to be waited for.
+	running := 0
 	tasks := make([]task, 0)
 	pendingTasks := make([]task, 0)
 	taskdone := make(chan task)
@@ -191,27 +419,54 @@ func (srv *server) run(dialer *dialstate) {
 			pendingTasks = pt[:len(pt)-start]
 		}
 	}
+running:
 	for {
 		now := time.Now()
 		nt := dialer.newTasks(len(pendingTasks)+len(tasks), srv.peers, now)
 		// schedule tasks
 		scheduleTasks(nt)
 		select {
+		case <-srv.close:
+			break running
 		case n := <-srv.addstatic:
 			dialer.addStatic(n)
 		case n := <-srv.rmstatic:
 			dialer.removeStatic(n)
 			for k, v := range srv.peers {
 				if bytes.Equal(k[:], n[:]) {
-					v.Close()
+					v.Disconnect(DiscRequested)
 				}
 			}
-			delete(srv.peers, n)
 		// add peer
 		case c := <-srv.addpeer:
-			p := newPeer(c, srv.protocols, srv.config.Encoder)
+			if err := srv.addPeerChecks(c); err != nil {
+				srv.logger.Infof("reject peer %s: %v", c.id, err)
+				srv.loopWG.Add(1)
+				go func() {
+					defer srv.loopWG.Done()
+					if reason, ok := err.(DiscReason); ok {
+						c.disconnect(reason)
+					}
+					c.close()
+				}()
+				break
+			}
+			if old, exists := srv.peers[c.id]; exists {
+				srv.logger.Infof("replace duplicate connection of peer %s", c.id)
+				old.Disconnect(DiscDuplicateConnection)
+			}
+			p := newPeer(c, matchProtocols(srv.protocols, c.caps), srv.config.Encoder)
+			srv.peersMu.Lock()
 			srv.peers[c.id] = p
+			srv.peersMu.Unlock()
 			srv.logger.Infof("save peer id to peers: %s", c.id)
+			srv.events.send(&PeerEvent{
+				Type:       PeerEventTypeAdd,
+				Peer:       c.id,
+				RemoteAddr: c.rw.RemoteAddr().String(),
+			})
+			srv.updatePeerMetrics()
+			running++
 			go srv.runPeer(p)
 		// task is done
 		case t := <-taskdone:
@@ -219,10 +474,198 @@ func (srv *server) run(dialer *dialstate) {
 			delTask(t)
 		// delete peer
 		case p := <-srv.delpeer:
-			pId := p.ID()
-			delete(srv.peers, pId)
+			running--
+			srv.dropPeer(p)
+		}
+	}
+	srv.logger.Infof("p2p server shutting down, disconnect %d peers", len(srv.peers))
+	for _, p := range srv.peers {
+		p.Disconnect(DiscQuitting)
+	}
+	// wait for the peers and the running tasks, handshakes of dial
+	// tasks give up once srv.close is closed.
+	for running > 0 || len(tasks) > 0 {
+		select {
+		case p := <-srv.delpeer:
+			running--
+			srv.dropPeer(p)
+		case t := <-taskdone:
+			delTask(t)
+		}
+	}
+}
+
+// dropPeer removes a stopped peer and emits its drop event. It must be
+// called from the run loop.
+func (srv *server) dropPeer(p Peer) {
+	pId := p.ID()
+	// the entry may belong to a connection which replaced p
+	if srv.peers[pId] == p {
+		srv.peersMu.Lock()
+		delete(srv.peers, pId)
+		srv.peersMu.Unlock()
+		srv.scores.forget(pId)
+	}
+	srv.events.send(&PeerEvent{
+		Type:   PeerEventTypeDrop,
+		Peer:   pId,
+		Reason: p.DiscReason().String(),
+	})
+	srv.updatePeerMetrics()
+}
+
+// updatePeerMetrics sets the peer count gauges. It must be called from
+// the run loop.
+func (srv *server) updatePeerMetrics() {
+	var inbound, static, dynamic int64
+	for _, p := range srv.peers {
+		switch {
+		case p.Is(flagInbound):
+			inbound++
+		case p.Is(flagStatic):
+			static++
+		case p.Is(flagDynamic):
+			dynamic++
+		}
+	}
+	reg := srv.metrics()
+	reg.Gauge("p2p_peers", "type", "inbound").Set(inbound)
+	reg.Gauge("p2p_peers", "type", "static").Set(static)
+	reg.Gauge("p2p_peers", "type", "dynamic").Set(dynamic)
+}
+
+// transport returns the configured transport or the TCP transport.
+func (srv *server) transport() Transport {
+	if srv.config.Transport == nil {
+		return &TCPTransport{}
+	}
+	return srv.config.Transport
+}
+
+// codecNames returns the registered codecs offered in the protocol handshake.
+func (srv *server) codecNames() []string {
+	if srv.config.NoCompression {
+		return nil
+	}
+	offered := srv.config.Compression
+	if offered == nil {
+		offered = []string{"snappy"}
+	}
+	var names []string
+	for _, name := range offered {
+		if len(names) == math.MaxUint8 {
+			break
+		}
+		if lookupCodec(name) != nil {
+			names = append(names, name)
 		}
 	}
+	return names
+}
+
+// closeContext returns a context derived from parent which is also
+// cancelled when the server stops.
+func (srv *server) closeContext(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-srv.close:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// metrics returns the registry of the server, metrics are discarded if
+// none is configured.
+func (srv *server) metrics() metrics.Registry {
+	return metrics.OrDiscard(srv.config.Metrics)
+}
+
+// startMetrics serves the metrics over HTTP if MetricsAddr is set.
+func (srv *server) startMetrics() error {
+	srv.metricsSrv = nil
+	if srv.config.MetricsAddr == "" {
+		return nil
+	}
+	exporter, ok := srv.config.Metrics.(metrics.Exporter)
+	if !ok {
+		return errors.New("metrics registry can not be exported over http")
+	}
+	ln, err := net.Listen("tcp", srv.config.MetricsAddr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(exporter))
+	srv.metricsSrv = &http.Server{Handler: mux}
+	srv.logger.Infof("p2p metrics served on http://%s/metrics", ln.Addr())
+	srv.loopWG.Add(1)
+	go func() {
+		defer srv.loopWG.Done()
+		if err := srv.metricsSrv.Serve(ln); err != http.ErrServerClosed {
+			srv.logger.Errorf("p2p metrics server err: %v", err)
+		}
+	}()
+	return nil
+}
+
+// maxInboundPeers returns the number of peers which may be inbound.
+func (srv *server) maxInboundPeers() int {
+	if srv.config.MaxInboundRatio <= 0 || srv.config.MaxInboundRatio >= 1 {
+		return srv.config.MaxPeers
+	}
+	return int(float64(srv.config.MaxPeers) * srv.config.MaxInboundRatio)
+}
+
+// addPeerChecks decides whether a connection which passed the handshake
+// may be added to the peers. It must be called from the run loop.
+func (srv *server) addPeerChecks(c *peerConn) error {
+	if bytes.Equal(c.id[:], srv.nodeId[:]) {
+		return DiscSelf
+	}
+	if srv.scores.banned(c.id, c.remoteIP()) {
+		return DiscBanned
+	}
+	old, exists := srv.peers[c.id]
+	if exists && !srv.keepNewConn(old, c) {
+		return DiscDuplicateConnection
+	}
+	if c.flag&flagStatic != 0 || srv.config.MaxPeers <= 0 {
+		return nil
+	}
+	// static peers and the connection replaced by c take no slot
+	count, inbound := 0, 0
+	for _, p := range srv.peers {
+		if p.Is(flagStatic) || p == old {
+			continue
+		}
+		count++
+		if p.Is(flagInbound) {
+			inbound++
+		}
+	}
+	if count >= srv.config.MaxPeers {
+		return DiscTooManyPeers
+	}
+	if c.flag&flagInbound != 0 && inbound >= srv.maxInboundPeers() {
+		return DiscTooManyPeers
+	}
+	return nil
+}
+
+// keepNewConn decides which of two connections to the same node is kept.
+// If both nodes dialed each other, both sides keep the connection dialed
+// by the node with the lower id. Otherwise the remote side has given up
+// the old connection, so the new one is kept.
+func (srv *server) keepNewConn(old Peer, c *peerConn) bool {
+	newOutbound := c.flag&flagOutbound != 0
+	if old.Is(flagOutbound) == newOutbound {
+		return true
+	}
+	selfDialer := bytes.Compare(srv.nodeId[:], c.id[:]) < 0
+	return newOutbound == selfDialer
 }
 
 func (srv *server) runPeer(peer Peer) {
@@ -230,56 +673,167 @@ func (srv *server) runPeer(peer Peer) {
 	srv.delpeer <- peer
 }
 
-func (srv *server) listenAndServe(realPort int) error {
+func (srv *server) listenAndServe(realPort int, altIPs []net.IP) error {
 	addr, err := net.ResolveTCPAddr("tcp", srv.config.ListenAddr)
-	addr.Port = realPort
-	ln, err := net.ListenTCP("tcp", addr)
-	laddr := ln.Addr().(*net.TCPAddr)
 	if err != nil {
-		srv.logger.Errorf("p2p listen and serve on %s err: %v", laddr, err)
 		return err
 	}
-	srv.logger.Infof("p2p listen and serve on %s", laddr)
+	if realPort > 0 {
+		addr.Port = realPort
+	}
+	laddr, err := srv.listen(addr)
+	if err != nil {
+		return err
+	}
+	addr.Port = laddr.Port
+	if addr.IP == nil && !laddr.IP.IsUnspecified() {
+		addr.IP = laddr.IP
+	}
+	for _, extra := range srv.config.ListenAddrs {
+		eaddr, err := net.ResolveTCPAddr("tcp", extra)
+		if err != nil {
+			srv.closeListeners()
+			return err
+		}
+		eaddr.Port = laddr.Port
+		if _, err = srv.listen(eaddr); err != nil {
+			srv.closeListeners()
+			return err
+		}
+	}
 
 	srv.node = discover.NewNode(addr.IP, uint16(addr.Port), uint16(addr.Port), srv.nodeId)
+	srv.node.AltIPs = altIPs
 	srv.logger.Infof("p2p server node id: %s", srv.nodeId)
-	go srv.listenLoop(ln)
+	for _, ln := range srv.listeners {
+		srv.loopWG.Add(1)
+		go srv.listenLoop(ln)
+	}
 	if !laddr.IP.IsLoopback() && srv.config.Nat != nil {
-		//srv.loopWG.Add(1)
+		srv.loopWG.Add(1)
 		go func() {
 			srv.logger.Debugf("nat mapping \"xlibp2p server\" port: %d", laddr.Port)
 			nat.Map(srv.config.Nat, srv.close, "tcp", laddr.Port, laddr.Port, "xlibp2p server")
-			//srv.loopWG.Done()
+			srv.loopWG.Done()
 		}()
 	}
 	return nil
 }
 
-// listenLoop runs in its own goroutine and accepts
-// request of connections.
-func (srv *server) listenLoop(ln net.Listener) {
-	defer func() {
+// listen opens a listener on addr and adds it to the listeners of the server.
+func (srv *server) listen(addr *net.TCPAddr) (*net.TCPAddr, error) {
+	ln, err := srv.transport().Listen(addr.String())
+	if err != nil {
+		srv.logger.Errorf("p2p listen and serve on %s err: %v", addr, err)
+		return nil, err
+	}
+	laddr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		_ = ln.Close()
+		return nil, fmt.Errorf("p2p listener address %s is not a tcp address", ln.Addr())
+	}
+	srv.listeners = append(srv.listeners, ln)
+	srv.logger.Infof("p2p listen and serve on %s", laddr)
+	return laddr, nil
+}
+
+func (srv *server) closeListeners() {
+	for _, ln := range srv.listeners {
 		if err := ln.Close(); err != nil {
 			srv.logger.Errorln(err)
 		}
-	}()
+	}
+	srv.listeners = nil
+}
+
+// altIPs returns the specified IPs of ListenAddrs which differ from
+// the IP of ListenAddr, they are announced next to the primary address.
+func (srv *server) altIPs() ([]net.IP, error) {
+	primary, err := net.ResolveTCPAddr("tcp", srv.config.ListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, extra := range srv.config.ListenAddrs {
+		addr, err := net.ResolveTCPAddr("tcp", extra)
+		if err != nil {
+			return nil, err
+		}
+		if addr.IP == nil || addr.IP.IsUnspecified() || addr.IP.Equal(primary.IP) {
+			continue
+		}
+		ips = append(ips, addr.IP)
+	}
+	return ips, nil
+}
+
+// listenLoop runs in its own goroutine and accepts
+// request of connections.
+func (srv *server) listenLoop(ln net.Listener) {
+	defer srv.loopWG.Done()
 	for {
+		// wait for a free handshake slot before accepting
+		select {
+		case <-srv.pendingSlots:
+		case <-srv.close:
+			return
+		}
 		rw, err := ln.Accept()
 		if err != nil {
-			srv.logger.Errorf("p2p listenner accept err %v", err)
+			select {
+			case <-srv.close:
+			default:
+				srv.logger.Errorf("p2p listenner accept err %v", err)
+			}
 			return
 		}
+		if !srv.config.NetRestrict.Permits(addrIP(rw.RemoteAddr())) {
+			srv.logger.Debugf("p2p refuse connection of restricted address %s", rw.RemoteAddr())
+			_ = rw.Close()
+			srv.pendingSlots <- struct{}{}
+			continue
+		}
+		if srv.scores.bannedAddr(rw.RemoteAddr()) {
+			srv.logger.Debugf("p2p refuse connection of banned address %s", rw.RemoteAddr())
+			_ = rw.Close()
+			srv.pendingSlots <- struct{}{}
+			continue
+		}
 		c := srv.newPeerConn(rw, flagInbound, nil)
-		go c.serve()
+		srv.loopWG.Add(1)
+		go func() {
+			defer srv.loopWG.Done()
+			c.serve()
+			srv.pendingSlots <- struct{}{}
+		}()
 	}
 }
 
 func (srv *server) AddPeer(node *discover.Node) {
-	srv.addstatic <- node
+	_ = srv.AddPeerContext(context.Background(), node)
+}
+
+func (srv *server) AddPeerContext(ctx context.Context, node *discover.Node) error {
+	srv.mu.Lock()
+	running, addstatic, closed := srv.running, srv.addstatic, srv.close
+	srv.mu.Unlock()
+	if !running {
+		return errServerStopped
+	}
+	select {
+	case addstatic <- node:
+		return nil
+	case <-closed:
+		return errServerStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (srv *server) Peers() []Peer {
-	tmp := make([]Peer, 0)
+	srv.peersMu.RLock()
+	defer srv.peersMu.RUnlock()
+	tmp := make([]Peer, 0, len(srv.peers))
 	for _, v := range srv.peers {
 		tmp = append(tmp, v)
 	}
@@ -287,7 +841,20 @@ func (srv *server) Peers() []Peer {
 }
 
 func (srv *server) RemovePeer(nId discover.NodeId) {
-	srv.rmstatic <- nId
+	srv.mu.Lock()
+	running, rmstatic, closed := srv.running, srv.rmstatic, srv.close
+	srv.mu.Unlock()
+	if !running {
+		return
+	}
+	select {
+	case rmstatic <- nId:
+	case <-closed:
+	}
+}
+
+func (srv *server) SubscribeEvents(ch chan<- *PeerEvent) Subscription {
+	return srv.events.subscribe(ch)
 }
 
 func (srv *server) NodeId() discover.NodeId {
@@ -308,7 +875,7 @@ func (srv *server) newPeerConn(rw net.Conn, flag int, dst *discover.NodeId) *pee
 		server:  srv,
 		key:     srv.config.Key,
 		rw:      rw,
-		version: version1,
+		version: version2,
 	}
 	if dst != nil {
 		c.id = *dst
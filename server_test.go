@@ -1,2 +1,718 @@
 package p2p
 
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/discover"
+	"github.com/xfs-network/xlibp2p/log"
+	"github.com/xfs-network/xlibp2p/metrics"
+	"github.com/xfs-network/xlibp2p/netutil"
+	"math"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func startTestServer(t *testing.T, config Config, ps ...Protocol) Server {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Key = key
+	if config.ListenAddr == "" {
+		config.ListenAddr = "127.0.0.1:0"
+	}
+	srv := NewServer(config)
+	for _, p := range ps {
+		if err = srv.Bind(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestServer_bind(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(Config{Key: key})
+	long := strings.Repeat("a", math.MaxUint8+1)
+	if err := srv.Bind(&testProtocol{name: long, version: 1}); err == nil {
+		t.Fatal("bound protocol with a name longer than 255 bytes")
+	}
+	if big := uint64(math.MaxUint32) + 1; uint64(uint(big)) == big {
+		if err := srv.Bind(&testProtocol{name: "a", version: uint(big)}); err == nil {
+			t.Fatal("bound protocol with a version beyond 32 bits")
+		}
+	}
+	for i := 0; i < math.MaxUint8; i++ {
+		if err := srv.Bind(&testProtocol{name: "a", version: uint(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := srv.Bind(&testProtocol{name: "b", version: 1}); err == nil {
+		t.Fatal("bound more than 255 protocols")
+	}
+}
+
+func TestServer_stopNotRunning(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(Config{ListenAddr: "127.0.0.1:0", Key: key})
+	srv.Stop()
+	if err = srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Stop()
+	srv.Stop()
+}
+
+func TestServer_stopDrainsPeers(t *testing.T) {
+	before := runtime.NumGoroutine()
+	started := make(chan discover.NodeId, 2)
+	stopped := make(chan discover.NodeId, 2)
+	proto := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		started <- p.ID()
+		<-p.CloseCh()
+		stopped <- p.ID()
+		return nil
+	}}
+	srvA := startTestServer(t, Config{}, proto)
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{srvA.Node()}}, proto)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("peers not connected")
+		}
+	}
+	srvA.Stop()
+	srvB.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-stopped:
+		default:
+			t.Fatal("protocol still running after stop")
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("got goroutines: %d, want: %d\n%s",
+				runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_disconnectReason(t *testing.T) {
+	started := make(chan Peer, 2)
+	reasons := make(chan DiscReason, 2)
+	proto := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		started <- p
+		<-p.CloseCh()
+		reasons <- p.DiscReason()
+		return nil
+	}}
+	srvA := startTestServer(t, Config{}, proto)
+	defer srvA.Stop()
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{srvA.Node()}}, proto)
+	defer srvB.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("peers not connected")
+		}
+	}
+	srvA.RemovePeer(srvB.NodeId())
+	for i := 0; i < 2; i++ {
+		select {
+		case reason := <-reasons:
+			if reason != DiscRequested {
+				t.Fatalf("got disconnect reason: %v, want: %v", reason, DiscRequested)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("peers not disconnected")
+		}
+	}
+}
+
+func TestServer_addPeerChecks(t *testing.T) {
+	srv := &server{
+		config: Config{MaxPeers: 4, MaxInboundRatio: 0.5},
+		peers:  make(map[discover.NodeId]Peer),
+	}
+	newConn := func(id byte, flag int) *peerConn {
+		return &peerConn{id: discover.NodeId{id}, flag: flag, logger: log.DefaultLogger()}
+	}
+	add := func(c *peerConn) error {
+		err := srv.addPeerChecks(c)
+		if err == nil {
+			srv.peers[c.id] = newPeer(c, nil, nil)
+		}
+		return err
+	}
+	tests := []struct {
+		conn *peerConn
+		want error
+	}{
+		// static peers take no slot
+		{newConn(8, flagOutbound|flagStatic), nil},
+		{newConn(1, flagInbound), nil},
+		{newConn(2, flagInbound), nil},
+		{newConn(3, flagInbound), DiscTooManyPeers},
+		{newConn(4, flagOutbound|flagDynamic), nil},
+		{newConn(5, flagOutbound|flagDynamic), nil},
+		{newConn(6, flagOutbound|flagDynamic), DiscTooManyPeers},
+		{newConn(7, flagOutbound|flagStatic), nil},
+	}
+	for i, test := range tests {
+		if err := add(test.conn); err != test.want {
+			t.Fatalf("test %d got err: %v, want: %v", i, err, test.want)
+		}
+	}
+}
+
+func TestServer_addPeerChecksUnlimited(t *testing.T) {
+	srv := &server{peers: make(map[discover.NodeId]Peer)}
+	for i := byte(1); i <= 3; i++ {
+		c := &peerConn{id: discover.NodeId{i}, flag: flagInbound, logger: log.DefaultLogger()}
+		if err := srv.addPeerChecks(c); err != nil {
+			t.Fatalf("peer %d got err: %v without MaxPeers", i, err)
+		}
+		srv.peers[c.id] = newPeer(c, nil, nil)
+	}
+}
+
+func TestServer_addPeerChecksDuplicate(t *testing.T) {
+	low, high := discover.NodeId{1}, discover.NodeId{2}
+	newConn := func(id discover.NodeId, flag int) *peerConn {
+		return &peerConn{id: id, flag: flag, logger: log.DefaultLogger()}
+	}
+	tests := []struct {
+		self     discover.NodeId
+		old, new *peerConn
+		want     error
+	}{
+		// the connection dialed by the lower id is kept on both sides
+		{low, newConn(high, flagInbound), newConn(high, flagOutbound|flagDynamic), nil},
+		{low, newConn(high, flagOutbound|flagDynamic), newConn(high, flagInbound), DiscDuplicateConnection},
+		{high, newConn(low, flagInbound), newConn(low, flagOutbound|flagDynamic), DiscDuplicateConnection},
+		{high, newConn(low, flagOutbound|flagDynamic), newConn(low, flagInbound), nil},
+		// a reconnect in the same direction replaces the old connection
+		{low, newConn(high, flagInbound), newConn(high, flagInbound), nil},
+		// connections to ourself are rejected
+		{low, nil, newConn(low, flagInbound), DiscSelf},
+	}
+	for i, test := range tests {
+		srv := &server{
+			nodeId: test.self,
+			config: Config{MaxPeers: 1},
+			peers:  make(map[discover.NodeId]Peer),
+		}
+		if test.old != nil {
+			srv.peers[test.old.id] = newPeer(test.old, nil, nil)
+		}
+		if err := srv.addPeerChecks(test.new); err != test.want {
+			t.Fatalf("test %d got err: %v, want: %v", i, err, test.want)
+		}
+	}
+}
+
+func TestServer_events(t *testing.T) {
+	proto := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		if err := p.WriteMessage(0, []byte("ping")); err != nil {
+			return err
+		}
+		<-p.CloseCh()
+		return nil
+	}}
+	srvA := startTestServer(t, Config{PingInterval: 10 * time.Millisecond}, proto)
+	defer srvA.Stop()
+	events := make(chan *PeerEvent, 16)
+	sub := srvA.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{srvA.Node()}}, proto)
+	defer srvB.Stop()
+	next := func(typ PeerEventType) *PeerEvent {
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == typ {
+					return ev
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no event of type %s", typ)
+			}
+		}
+	}
+	if ev := next(PeerEventTypeAdd); ev.Peer != srvB.NodeId() {
+		t.Fatalf("got added peer: %s, want: %s", ev.Peer, srvB.NodeId())
+	}
+	ev := next(PeerEventTypeMsgRecv)
+	if ev.Protocol != "test" || ev.MsgCode != 0 || ev.MsgSize != 4 {
+		t.Fatalf("got message event: %+v", ev)
+	}
+	srvA.RemovePeer(srvB.NodeId())
+	if ev = next(PeerEventTypeDrop); ev.Reason != DiscRequested.String() {
+		t.Fatalf("got drop reason: %s, want: %s", ev.Reason, DiscRequested)
+	}
+}
+
+func TestEventFeed_unsubscribe(t *testing.T) {
+	var feed eventFeed
+	ch := make(chan *PeerEvent, 1)
+	sub := feed.subscribe(ch)
+	feed.send(&PeerEvent{Type: PeerEventTypeAdd})
+	// the channel is full, the event must be dropped without blocking
+	feed.send(&PeerEvent{Type: PeerEventTypeDrop})
+	if ev := <-ch; ev.Type != PeerEventTypeAdd {
+		t.Fatalf("got event: %s, want: %s", ev.Type, PeerEventTypeAdd)
+	}
+	sub.Unsubscribe()
+	sub.Unsubscribe()
+	feed.send(&PeerEvent{Type: PeerEventTypeAdd})
+	if len(ch) != 0 {
+		t.Fatal("got event after unsubscribe")
+	}
+}
+
+func TestServer_metrics(t *testing.T) {
+	received := make(chan struct{}, 2)
+	proto := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		if err := p.WriteMessage(0, []byte("ping")); err != nil {
+			return err
+		}
+		select {
+		case <-p.GetProtocolMsgCh():
+			received <- struct{}{}
+		case <-p.CloseCh():
+			return nil
+		}
+		<-p.CloseCh()
+		return nil
+	}}
+	reg := metrics.NewRegistry()
+	srvA := startTestServer(t, Config{Metrics: reg, MetricsAddr: "127.0.0.1:0"}, proto)
+	defer srvA.Stop()
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{srvA.Node()}}, proto)
+	defer srvB.Stop()
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no protocol message received")
+	}
+	buf := new(bytes.Buffer)
+	if err := reg.WritePrometheus(buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`p2p_peers{type="inbound"} 1`,
+		`p2p_handshakes_total{direction="inbound",result="success"} 1`,
+		`p2p_ingress_messages_total{protocol="test",code="0"} 1`,
+		`p2p_ingress_bytes_total{protocol="test",code="0"} 4`,
+		`p2p_egress_messages_total{protocol="test",code="0"} 1`,
+		`p2p_handshake_duration_seconds_count{direction="inbound"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("metrics do not contain %q:\n%s", want, buf)
+		}
+	}
+}
+
+func TestServer_metricsNotExported(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(Config{ListenAddr: "127.0.0.1:0", Key: key, MetricsAddr: "127.0.0.1:0"})
+	if err = srv.Start(); err == nil {
+		srv.Stop()
+		t.Fatal("start with metrics address and no exporter should fail")
+	}
+}
+
+func TestServer_listenAddrs(t *testing.T) {
+	if ln, err := net.Listen("tcp", "[::1]:0"); err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	} else {
+		_ = ln.Close()
+	}
+	started := make(chan discover.NodeId, 2)
+	proto := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		started <- p.ID()
+		<-p.CloseCh()
+		return nil
+	}}
+	srvA := startTestServer(t, Config{ListenAddrs: []string{"[::1]:0"}}, proto)
+	defer srvA.Stop()
+	self := srvA.Node()
+	if len(self.AltIPs) != 1 || !self.AltIPs[0].Equal(net.IPv6loopback) {
+		t.Fatalf("got alt ips: %v, want: [%v]", self.AltIPs, net.IPv6loopback)
+	}
+	// the primary address refuses connections, the dialer must
+	// fall back to the IPv6 address
+	dest := discover.NewNode(net.IP{127, 0, 0, 3}, self.UDP, self.TCP, self.ID)
+	dest.AltIPs = self.AltIPs
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{dest}}, proto)
+	defer srvB.Stop()
+	for i := 0; i < 2; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("peers not connected")
+		}
+	}
+}
+
+func TestServer_addPeerContext(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(Config{ListenAddr: "127.0.0.1:0", Key: key})
+	node := discover.NewNode(net.IP{127, 0, 0, 1}, 1, 1, discover.NodeId{1})
+	// the server is not running, nothing receives the node
+	if err = srv.AddPeerContext(context.Background(), node); err != errServerStopped {
+		t.Fatalf("got err: %v, want: %v", err, errServerStopped)
+	}
+	if err = srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = srv.AddPeerContext(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServer_banPeer(t *testing.T) {
+	protoA := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		p.Report(-200, "misbehaving")
+		<-p.CloseCh()
+		return nil
+	}}
+	protoB := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		<-p.CloseCh()
+		return nil
+	}}
+	srvA := startTestServer(t, Config{}, protoA)
+	defer srvA.Stop()
+	events := make(chan *PeerEvent, 16)
+	sub := srvA.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{srvA.Node()}}, protoB)
+	defer srvB.Stop()
+	var banned, dropped bool
+	for !banned || !dropped {
+		select {
+		case ev := <-events:
+			switch ev.Type {
+			case PeerEventTypeBanned:
+				banned = ev.Peer == srvB.NodeId() && ev.Reason == "misbehaving"
+			case PeerEventTypeDrop:
+				if ev.Reason != DiscBanned.String() {
+					t.Fatalf("got drop reason: %s, want: %s", ev.Reason, DiscBanned)
+				}
+				dropped = true
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("peer not banned")
+		}
+	}
+	if !srvA.(*server).scores.banned(srvB.NodeId(), nil) {
+		t.Fatal("ban not recorded")
+	}
+}
+
+func TestServer_netRestrict(t *testing.T) {
+	proto := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		<-p.CloseCh()
+		return nil
+	}}
+	loopback := new(netutil.Restriction)
+	loopback.Deny.MustAdd("127.0.0.0/8")
+	srvA := startTestServer(t, Config{NetRestrict: loopback}, proto)
+	defer srvA.Stop()
+	// the listener of A refuses the connection, so the handshake fails
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srvB := NewServer(Config{ListenAddr: "127.0.0.1:0", Key: key, MaxPeers: 10,
+		StaticNodes: []*discover.Node{srvA.Node()}})
+	events := make(chan *PeerEvent, 16)
+	sub := srvB.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+	if err = srvB.Bind(proto); err != nil {
+		t.Fatal(err)
+	}
+	if err = srvB.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srvB.Stop()
+	for failed := false; !failed; {
+		select {
+		case ev := <-events:
+			if ev.Type == PeerEventTypeAdd {
+				t.Fatal("restricted peer added")
+			}
+			failed = ev.Type == PeerEventTypeHandshakeFailed
+		case <-time.After(5 * time.Second):
+			t.Fatal("connection not refused")
+		}
+	}
+	// C does not dial addresses outside of its allowed networks
+	lan := new(netutil.Restriction)
+	lan.Allow.MustAdd("10.0.0.0/8")
+	reg := metrics.NewRegistry()
+	srvC := startTestServer(t, Config{NetRestrict: lan, Metrics: reg, StaticNodes: []*discover.Node{srvA.Node()}}, proto)
+	defer srvC.Stop()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		buf := new(bytes.Buffer)
+		if err := reg.WritePrometheus(buf); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(buf.String(), `p2p_dials_total{result="restricted"} 1`) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("restricted dial not counted:\n%s", buf)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_rateLimit(t *testing.T) {
+	const size, count = 10 * 1024, 4
+	received := make(chan struct{}, count)
+	sender := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		for i := 0; i < count; i++ {
+			if err := p.WriteMessage(0, make([]byte, size)); err != nil {
+				return err
+			}
+		}
+		<-p.CloseCh()
+		return nil
+	}}
+	receiver := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		for {
+			select {
+			case <-p.GetProtocolMsgCh():
+				received <- struct{}{}
+			case <-p.CloseCh():
+				return nil
+			}
+		}
+	}}
+	limit := netutil.RateLimit{Egress: 2 * size}
+	srvA := startTestServer(t, Config{NoCompression: true, PeerRateLimit: limit}, sender)
+	defer srvA.Stop()
+	start := time.Now()
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{srvA.Node()}}, receiver)
+	defer srvB.Stop()
+	for i := 0; i < count; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d messages, want: %d", i, count)
+		}
+	}
+	// the burst covers two messages, the last ones wait for the limit
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Fatalf("got %d messages in %v, want at least: %v", count, elapsed, 400*time.Millisecond)
+	}
+	stats := srvA.Bandwidth()
+	if len(stats.Peers) != 1 {
+		t.Fatalf("got peer stats: %d, want: 1", len(stats.Peers))
+	}
+	for _, b := range stats.Peers {
+		if b.EgressLimit != limit.Egress || b.IngressLimit != 0 {
+			t.Fatalf("got peer limits: %d/%d, want: %d/0", b.EgressLimit, b.IngressLimit, limit.Egress)
+		}
+	}
+	if got := stats.Protocols["test"].EgressTotal; got < count*size {
+		t.Fatalf("got protocol egress: %d, want at least: %d", got, count*size)
+	}
+	if stats.Total.EgressTotal < stats.Protocols["test"].EgressTotal || stats.Total.EgressRate <= 0 {
+		t.Fatalf("got total egress: %+v", stats.Total)
+	}
+}
+
+func TestServer_peersInfo(t *testing.T) {
+	proto := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		<-p.CloseCh()
+		return nil
+	}}
+	srvA := startTestServer(t, Config{}, proto)
+	defer srvA.Stop()
+	events := make(chan *PeerEvent, 16)
+	sub := srvA.SubscribeEvents(events)
+	defer sub.Unsubscribe()
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{srvA.Node()}}, proto)
+	defer srvB.Stop()
+	// PeersInfo is safe to call while peers are added
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			srvA.PeersInfo()
+		}
+	}()
+	for ev := range events {
+		if ev.Type == PeerEventTypeAdd {
+			break
+		}
+	}
+	<-done
+	// wait for the first heartbeat responses
+	var info *PeerInfo
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		infos := srvA.PeersInfo()
+		if len(infos) != 1 {
+			t.Fatalf("got peers: %d, want: 1", len(infos))
+		}
+		if info = infos[0]; info.RTT > 0 || time.Now().After(deadline) {
+			break
+		}
+	}
+	if info.ID != srvB.NodeId().String() || !info.Inbound || info.Static || info.Direction != "inbound" {
+		t.Fatalf("got inbound peer info: %+v", info)
+	}
+	if info.RemoteAddr == "" || info.LocalAddr == "" || !strings.Contains(info.Node, info.ID) {
+		t.Fatalf("got peer addresses: %+v", info)
+	}
+	if len(info.Protocols) != 1 || info.Protocols[0] != (Cap{Name: "test", Version: 1}) {
+		t.Fatalf("got protocols: %v", info.Protocols)
+	}
+	if info.ConnectedSince.IsZero() || info.RTT == 0 || info.BytesIn == 0 || info.BytesOut == 0 {
+		t.Fatalf("got peer info: %+v", info)
+	}
+	out := srvB.Peer(srvA.NodeId())
+	if out == nil || !out.Static || out.Inbound || out.Direction != "outbound" {
+		t.Fatalf("got outbound peer info: %+v", out)
+	}
+	if srvB.Peer(srvB.NodeId()) != nil {
+		t.Fatal("got info of a peer which is not connected")
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"protocols":[{"name":"test","version":1}]`) {
+		t.Fatalf("got json: %s", data)
+	}
+}
+
+func TestServer_stopWaitsForReplacedPeer(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	first := true
+	var mu sync.Mutex
+	proto := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		mu.Lock()
+		hold := first
+		first = false
+		mu.Unlock()
+		started <- struct{}{}
+		<-p.CloseCh()
+		if hold {
+			// the replaced peer is still running when the server stops
+			<-release
+		}
+		return nil
+	}}
+	remote := &testProtocol{name: "test", version: 1, length: 1, run: func(p ProtocolPeer) error {
+		<-p.CloseCh()
+		return nil
+	}}
+	srvA := startTestServer(t, Config{}, proto)
+	srvB := startTestServer(t, Config{StaticNodes: []*discover.Node{srvA.Node()}}, remote)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("peers not connected")
+	}
+	// a second connection of the same node replaces the first one
+	key := srvB.(*server).config.Key
+	srvB.Stop()
+	srvC := NewServer(Config{Key: key, ListenAddr: "127.0.0.1:0", MaxPeers: 10,
+		StaticNodes: []*discover.Node{srvA.Node()}})
+	if err := srvC.Bind(remote); err != nil {
+		t.Fatal(err)
+	}
+	if err := srvC.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer srvC.Stop()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("second connection not added")
+	}
+	stopped := make(chan struct{})
+	go func() {
+		srvA.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop returned while the replaced peer was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stop did not return")
+	}
+}
+
+func TestServer_removePeerNotRunning(t *testing.T) {
+	key, err := crypto.GenPrvKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer(Config{ListenAddr: "127.0.0.1:0", Key: key})
+	removed := func() bool {
+		done := make(chan struct{})
+		go func() {
+			srv.RemovePeer(discover.NodeId{1})
+			close(done)
+		}()
+		select {
+		case <-done:
+			return true
+		case <-time.After(time.Second):
+			return false
+		}
+	}
+	if !removed() {
+		t.Fatal("RemovePeer blocked before Start")
+	}
+	if err = srv.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if !removed() {
+		t.Fatal("RemovePeer blocked on a running server")
+	}
+	srv.Stop()
+	if !removed() {
+		t.Fatal("RemovePeer blocked after Stop")
+	}
+}
@@ -0,0 +1,178 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Transport creates the streams which carry peer connections. Addresses
+// are host:port strings as announced by discover.Node.
+type Transport interface {
+	// Listen announces on the local address, port 0 picks a free port.
+	// The listener must return a *net.TCPAddr from Addr.
+	Listen(addr string) (net.Listener, error)
+	// Dial connects to the address, it gives up when ctx is done.
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// PacketTransport is implemented by transports running over UDP. The node
+// discovery then shares the socket of the transport instead of opening its
+// own, as both use the listening port.
+type PacketTransport interface {
+	Transport
+	// ListenPacket opens the UDP socket of the address, a later Listen on
+	// the same port uses it too. Packets for which match returns true are
+	// read from the returned conn, the others belong to the transport.
+	ListenPacket(addr string, match func(packet []byte) bool) (PacketConn, error)
+}
+
+// PacketConn is the UDP socket of the node discovery.
+type PacketConn interface {
+	ReadFromUDP(b []byte) (n int, addr *net.UDPAddr, err error)
+	WriteToUDP(b []byte, addr *net.UDPAddr) (n int, err error)
+	Close() error
+	LocalAddr() net.Addr
+}
+
+// TCPTransport is the default transport, it uses plain TCP connections.
+type TCPTransport struct {
+	Dialer net.Dialer
+}
+
+func (t *TCPTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (t *TCPTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return t.Dialer.DialContext(ctx, "tcp", addr)
+}
+
+var errAddrInUse = errors.New("address already in use")
+
+// MemTransport connects servers in the same process through in-memory
+// pipes, without opening any sockets. All servers of a test network must
+// share one MemTransport. Node discovery still uses UDP, so it should be
+// disabled and peers added as static nodes.
+type MemTransport struct {
+	mu        sync.Mutex
+	listeners map[string]*memListener
+	nextPort  int
+}
+
+// NewMemTransport creates an empty in-memory network.
+func NewMemTransport() *MemTransport {
+	return &MemTransport{
+		listeners: make(map[string]*memListener),
+		nextPort:  1024,
+	}
+}
+
+func (t *MemTransport) Listen(addr string) (net.Listener, error) {
+	laddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if laddr.IP == nil || laddr.IP.IsUnspecified() {
+		laddr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if laddr.Port == 0 {
+		for t.listeners[memKey(laddr.IP, t.nextPort)] != nil {
+			t.nextPort++
+		}
+		laddr.Port = t.nextPort
+		t.nextPort++
+	}
+	key := memKey(laddr.IP, laddr.Port)
+	if t.listeners[key] != nil {
+		return nil, errAddrInUse
+	}
+	ln := &memListener{
+		transport: t,
+		key:       key,
+		addr:      laddr,
+		accept:    make(chan net.Conn),
+		closed:    make(chan struct{}),
+	}
+	t.listeners[key] = ln
+	return ln, nil
+}
+
+func (t *MemTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	ln := t.listeners[memKey(raddr.IP, raddr.Port)]
+	laddr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: t.nextPort}
+	t.nextPort++
+	t.mu.Unlock()
+	if ln == nil {
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	}
+	local, remote := net.Pipe()
+	select {
+	case ln.accept <- &memConn{Conn: remote, local: ln.addr, remote: laddr}:
+		return &memConn{Conn: local, local: laddr, remote: ln.addr}, nil
+	case <-ln.closed:
+		return nil, fmt.Errorf("dial %s: connection refused", addr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func memKey(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+type memListener struct {
+	transport *MemTransport
+	key       string
+	addr      *net.TCPAddr
+	accept    chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (ln *memListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-ln.accept:
+		return c, nil
+	case <-ln.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (ln *memListener) Close() error {
+	ln.closeOnce.Do(func() {
+		ln.transport.mu.Lock()
+		delete(ln.transport.listeners, ln.key)
+		ln.transport.mu.Unlock()
+		close(ln.closed)
+	})
+	return nil
+}
+
+func (ln *memListener) Addr() net.Addr {
+	return ln.addr
+}
+
+// memConn reports the addresses of the in-memory endpoints.
+type memConn struct {
+	net.Conn
+	local, remote *net.TCPAddr
+}
+
+func (c *memConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *memConn) RemoteAddr() net.Addr {
+	return c.remote
+}
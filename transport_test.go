@@ -0,0 +1,82 @@
+package p2p
+
+import (
+	"context"
+	"github.com/xfs-network/xlibp2p/crypto"
+	"github.com/xfs-network/xlibp2p/discover"
+	"testing"
+	"time"
+)
+
+func TestMemTransport(t *testing.T) {
+	tr := NewMemTransport()
+	ln, err := tr.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = tr.Listen(ln.Addr().String()); err != errAddrInUse {
+		t.Fatalf("got err: %v, want: %v", err, errAddrInUse)
+	}
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = c.Write([]byte("hi"))
+	}()
+	c, err := tr.Dial(context.Background(), ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err = c.Read(buf); err != nil || string(buf) != "hi" {
+		t.Fatalf("got data: %q, err: %v", buf, err)
+	}
+	if c.RemoteAddr().String() != ln.Addr().String() {
+		t.Fatalf("got remote addr: %s, want: %s", c.RemoteAddr(), ln.Addr())
+	}
+	_ = ln.Close()
+	if _, err = tr.Dial(context.Background(), ln.Addr().String()); err == nil {
+		t.Fatal("dial closed listener should fail")
+	}
+}
+
+func TestServer_memTransportRing(t *testing.T) {
+	const n = 32
+	tr := NewMemTransport()
+	servers := make([]Server, n)
+	events := make(chan *PeerEvent, 4*n)
+	for i := 0; i < n; i++ {
+		key, err := crypto.GenPrvKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := Config{Key: key, ListenAddr: "127.0.0.1:0", MaxPeers: 10, Transport: tr}
+		if i > 0 {
+			config.StaticNodes = []*discover.Node{servers[i-1].Node()}
+		}
+		if i == n-1 {
+			// close the ring
+			config.StaticNodes = append(config.StaticNodes, servers[0].Node())
+		}
+		servers[i] = NewServer(config)
+		sub := servers[i].SubscribeEvents(events)
+		defer sub.Unsubscribe()
+		if err = servers[i].Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer servers[i].Stop()
+	}
+	// every server adds both of its neighbours
+	deadline := time.After(10 * time.Second)
+	for added := 0; added < 2*n; {
+		select {
+		case ev := <-events:
+			if ev.Type == PeerEventTypeAdd {
+				added++
+			}
+		case <-deadline:
+			t.Fatalf("got peer add events: %d, want: %d", added, 2*n)
+		}
+	}
+}